@@ -0,0 +1,241 @@
+package dwarf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// DW_EH_PE_* encodings (from the LSB/.eh_frame convention, not the
+// core DWARF spec) describe how a pointer value is represented and,
+// via the high nibble, what it's relative to.
+const (
+	dw_EH_PE_absptr  = 0x00
+	dw_EH_PE_uleb128 = 0x01
+	dw_EH_PE_udata2  = 0x02
+	dw_EH_PE_udata4  = 0x03
+	dw_EH_PE_udata8  = 0x04
+	dw_EH_PE_sleb128 = 0x09
+	dw_EH_PE_sdata2  = 0x0a
+	dw_EH_PE_sdata4  = 0x0b
+	dw_EH_PE_sdata8  = 0x0c
+	dw_EH_PE_omit    = 0xff
+
+	dw_EH_PE_pcrel   = 0x10
+	dw_EH_PE_textrel = 0x20
+	dw_EH_PE_datarel = 0x30
+	dw_EH_PE_funcrel = 0x40
+	dw_EH_PE_aligned = 0x50
+)
+
+// LoadEHFrame attaches .eh_frame unwind data to d, for use by
+// CanonicalFrameAddress/FrameAt when .debug_frame isn't present. Every
+// ELF binary normally carries .eh_frame (it's how C++ exceptions
+// unwind the stack), so this lets unwinding work even for code built
+// without -g. addr is the section's runtime load address (its ELF
+// sh_addr / Mach-O addr), needed to resolve DW_EH_PE_pcrel pointers
+// against the PCs the rest of this package is given.
+func (d *Data) LoadEHFrame(ehFrame []byte, addr uintptr) {
+	d.ehFrame = ehFrame
+	d.ehFrameAddr = addr
+}
+
+// readInitialLength reads a DWARF "initial length" field: a 4-byte
+// length, or, if that's the reserved value 0xffffffff, an 8-byte
+// length in the 64-bit DWARF format that follows it.
+func readInitialLength(stream *bytes.Reader, order binary.ByteOrder) (length uint64, is64 bool, err error) {
+	var length32 uint32
+	if err := binary.Read(stream, order, &length32); err != nil {
+		return 0, false, err
+	}
+
+	if length32 != 0xffffffff {
+		return uint64(length32), false, nil
+	}
+
+	var length64 uint64
+	if err := binary.Read(stream, order, &length64); err != nil {
+		return 0, false, err
+	}
+
+	return length64, true, nil
+}
+
+// readSectionOffset reads a section offset: 4 bytes in the 32-bit
+// DWARF format, or 8 in the 64-bit format readInitialLength detected.
+func readSectionOffset(stream *bytes.Reader, order binary.ByteOrder, is64 bool) (uint64, error) {
+	if is64 {
+		var v uint64
+		err := binary.Read(stream, order, &v)
+		return v, err
+	}
+
+	var v uint32
+	err := binary.Read(stream, order, &v)
+	return uint64(v), err
+}
+
+// parseEHAugmentation interprets a CIE's augmentation string following
+// the conventions gcc/clang use for .eh_frame (there's no ISO spec for
+// it): if it starts with 'z', a ULEB128 length and that many bytes of
+// augmentation data follow the CIE's return_address_register, and the
+// remaining letters say how to interpret that data. We only need 'R',
+// which gives the encoding FDEs should use for their PC fields; 'L'
+// and 'P' are parsed only so we consume the right number of bytes.
+func parseEHAugmentation(augmentation string, stream *bytes.Reader, order binary.ByteOrder) (fdeEncoding byte, err error) {
+	fdeEncoding = dw_EH_PE_absptr
+
+	if augmentation == "" {
+		return fdeEncoding, nil
+	}
+
+	if augmentation[0] != 'z' {
+		return 0, fmt.Errorf("dwarf/unwind: unhandled CIE augmentation %q", augmentation)
+	}
+
+	length, err := parseUnsignedLEB128(stream)
+	if err != nil {
+		return 0, err
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(stream, data); err != nil {
+		return 0, err
+	}
+
+	buf := bytes.NewReader(data)
+
+	for _, c := range augmentation[1:] {
+		switch c {
+		case 'R':
+			b, err := buf.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			fdeEncoding = b
+
+		case 'L':
+			// The LSDA pointer encoding; the LSDA itself lives in the
+			// FDE, not here, so there's nothing to skip beyond the byte
+			// we just read.
+			if _, err := buf.ReadByte(); err != nil {
+				return 0, err
+			}
+
+		case 'P':
+			encoding, err := buf.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			if _, err := decodeEncodedPointer(buf, order, encoding, 0); err != nil {
+				return 0, err
+			}
+
+		default:
+			return 0, fmt.Errorf("dwarf/unwind: unhandled CIE augmentation letter %q", c)
+		}
+	}
+
+	return fdeEncoding, nil
+}
+
+// decodeEncodedPointer reads one pointer value encoded per a DW_EH_PE_*
+// byte: the low nibble selects the value's representation, and the
+// high nibble says what runtime address (if any) it's relative to.
+// fieldAddr is the runtime address of the encoded field itself (the
+// section's load address plus the field's offset into it), needed to
+// resolve DW_EH_PE_pcrel.
+func decodeEncodedPointer(stream *bytes.Reader, order binary.ByteOrder, encoding byte, fieldAddr uintptr) (uintptr, error) {
+	if encoding == dw_EH_PE_omit {
+		return 0, nil
+	}
+
+	var raw uint64
+
+	switch encoding & 0x0f {
+	case dw_EH_PE_absptr:
+		var v uint64
+		if err := binary.Read(stream, order, &v); err != nil {
+			return 0, err
+		}
+		raw = v
+
+	case dw_EH_PE_udata2:
+		var v uint16
+		if err := binary.Read(stream, order, &v); err != nil {
+			return 0, err
+		}
+		raw = uint64(v)
+
+	case dw_EH_PE_sdata2:
+		var v int16
+		if err := binary.Read(stream, order, &v); err != nil {
+			return 0, err
+		}
+		raw = uint64(int64(v))
+
+	case dw_EH_PE_udata4:
+		var v uint32
+		if err := binary.Read(stream, order, &v); err != nil {
+			return 0, err
+		}
+		raw = uint64(v)
+
+	case dw_EH_PE_sdata4:
+		var v int32
+		if err := binary.Read(stream, order, &v); err != nil {
+			return 0, err
+		}
+		raw = uint64(int64(v))
+
+	case dw_EH_PE_udata8:
+		var v uint64
+		if err := binary.Read(stream, order, &v); err != nil {
+			return 0, err
+		}
+		raw = v
+
+	case dw_EH_PE_sdata8:
+		var v int64
+		if err := binary.Read(stream, order, &v); err != nil {
+			return 0, err
+		}
+		raw = uint64(v)
+
+	case dw_EH_PE_uleb128:
+		n, err := parseUnsignedLEB128(stream)
+		if err != nil {
+			return 0, err
+		}
+		raw = n
+
+	case dw_EH_PE_sleb128:
+		n, err := parseSignedLEB128(stream)
+		if err != nil {
+			return 0, err
+		}
+		raw = uint64(n)
+
+	default:
+		return 0, fmt.Errorf("dwarf/unwind: unsupported DW_EH_PE encoding: %#x", encoding)
+	}
+
+	val := uintptr(raw)
+
+	switch encoding & 0x70 {
+	case 0:
+		// Absolute; nothing to add.
+	case dw_EH_PE_pcrel:
+		val += fieldAddr
+	default:
+		// Only absolute and pcrel values are resolved. datarel and
+		// funcrel are relative to a data section base and to the FDE's
+		// own function respectively, neither of which is fieldAddr or
+		// known to a cfiSource; these, like textrel and aligned, return
+		// an error rather than a pointer.
+		return 0, fmt.Errorf("dwarf/unwind: unsupported DW_EH_PE base: %#x", encoding&0x70)
+	}
+
+	return val, nil
+}
@@ -0,0 +1,123 @@
+package dwarf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// buildULEB128 appends v to buf in ULEB128 form.
+func buildULEB128(buf *bytes.Buffer, v uint64) {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			b |= 0x80
+		}
+		buf.WriteByte(b)
+		if v == 0 {
+			break
+		}
+	}
+}
+
+// buildSLEB128 appends v to buf in SLEB128 form.
+func buildSLEB128(buf *bytes.Buffer, v int64) {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		signBitSet := b&0x40 != 0
+		if (v == 0 && !signBitSet) || (v == -1 && signBitSet) {
+			buf.WriteByte(b)
+			break
+		}
+		buf.WriteByte(b | 0x80)
+	}
+}
+
+// buildEHFrame assembles a minimal synthetic .eh_frame: one CIE using
+// the 'zR' augmentation with an FDE encoding of pcrel|sdata4, and one
+// FDE covering [pc, pc+size) whose initial_location is encoded
+// relative to loadAddr, the way a real linked binary's .eh_frame does.
+// instructions is appended to the FDE as its own CFI program, the way
+// a real (non-initial) FDE almost always carries some.
+func buildEHFrame(loadAddr uintptr, pc uintptr, size uint32, instructions []byte) []byte {
+	var cieBody bytes.Buffer
+	binary.Write(&cieBody, binary.LittleEndian, uint32(0)) // CIE_id
+	cieBody.WriteByte(1)                                   // version
+	cieBody.WriteString("zR\x00")                          // augmentation
+	buildULEB128(&cieBody, 1)                              // code_alignment_factor
+	buildSLEB128(&cieBody, -8)                             // data_alignment_factor
+	cieBody.WriteByte(16)                                  // return_address_register
+	buildULEB128(&cieBody, 1)                              // augmentation data length
+	cieBody.WriteByte(dw_EH_PE_pcrel | dw_EH_PE_sdata4)    // 'R': FDE encoding
+	// no initial instructions
+
+	var ehFrame bytes.Buffer
+	binary.Write(&ehFrame, binary.LittleEndian, uint32(cieBody.Len()))
+	ehFrame.Write(cieBody.Bytes())
+
+	cieOffset := uint32(0)
+
+	fdeFieldAddr := func(offsetInBuf int) uintptr {
+		return loadAddr + uintptr(offsetInBuf)
+	}
+
+	var fdeBody bytes.Buffer
+	// cie_pointer: the offset (in bytes, within the section) of this
+	// very field, since cieOffset is 0.
+	ciePointerFieldOffset := ehFrame.Len() + 4 // +4 for the FDE's own length field
+	binary.Write(&fdeBody, binary.LittleEndian, uint32(ciePointerFieldOffset)-cieOffset)
+
+	initialLocationFieldOffset := ehFrame.Len() + 4 + fdeBody.Len()
+	raw := int32(int64(pc) - int64(fdeFieldAddr(initialLocationFieldOffset)))
+	binary.Write(&fdeBody, binary.LittleEndian, raw)
+
+	binary.Write(&fdeBody, binary.LittleEndian, int32(size)) // address_range, plain sdata4
+	// no augmentation data (none of 'L'/'P' are present)
+	fdeBody.Write(instructions)
+
+	binary.Write(&ehFrame, binary.LittleEndian, uint32(fdeBody.Len()))
+	ehFrame.Write(fdeBody.Bytes())
+
+	return ehFrame.Bytes()
+}
+
+// TestEHFrameResolvesAgainstLoadAddress makes sure an FDE's
+// DW_EH_PE_pcrel initial_location is resolved against the .eh_frame
+// section's real runtime load address, not just its byte offset within
+// the section - otherwise the computed PC range bears no relation to
+// the process' actual PCs, which breaks unwinding for any binary that
+// ships .eh_frame without .debug_frame.
+func TestEHFrameResolvesAgainstLoadAddress(t *testing.T) {
+	const loadAddr = 0x400000
+	const pc = 0x401234
+	const size = 0x100
+
+	instructions := []byte{dw_CFA_def_cfa_offset, 16}
+
+	d, err := New(nil, nil, nil, nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.LoadEHFrame(buildEHFrame(loadAddr, pc, size, instructions), loadAddr)
+
+	fde, err := d.fdeForPC(pc + 8)
+	if err != nil {
+		t.Fatalf("fdeForPC(%#x): %v", pc+8, err)
+	}
+
+	if fde.InitialLocation != pc {
+		t.Errorf("InitialLocation = %#x, want %#x", fde.InitialLocation, pc)
+	}
+	if fde.AddressRange != size {
+		t.Errorf("AddressRange = %#x, want %#x", fde.AddressRange, size)
+	}
+	if !bytes.Equal(fde.Instructions, instructions) {
+		t.Errorf("Instructions = %#v, want %#v", fde.Instructions, instructions)
+	}
+
+	if _, err := d.fdeForPC(pc - 1); err == nil {
+		t.Errorf("fdeForPC(%#x) unexpectedly found a frame below the FDE's range", pc-1)
+	}
+}
@@ -6,24 +6,46 @@ import (
 
 // Get an attribute from the dwarf entry by type.
 func (entry *Entry) Attribute(attr Attr) interface{} {
-	for _, f := range(entry.Field) {
-        if (f.Attr == attr) {
-            return f.Val
-        }
-    }
-    return nil
-
+	for _, f := range entry.Field {
+		if f.Attr == attr {
+			return f.Val
+		}
+	}
+	return nil
 }
 
-// Calculate the location of this entry relative to the
-// canonical frame address.
-func (entry *Entry) Location(cfa uintptr) (uintptr, error) {
+// Location evaluates entry's AttrLocation expression (or, for an
+// entry whose location varies by pc, the matching entry of its
+// location list) and returns where it says the value lives: in
+// memory, in a register, spread across several pieces, or nowhere at
+// all. pc selects the applicable location-list entry and is otherwise
+// unused; cfa, regs, and mem are threaded through to evalExpression
+// for opcodes (DW_OP_call_frame_cfa, DW_OP_bregN, DW_OP_deref, ...)
+// that need them.
+func (entry *Entry) Location(d *Data, pc uintptr, cfa uintptr, regs Registers, mem MemReader) (Location, error) {
+
+	info := locInfo{CanonicalFrameAddress: cfa, Order: d.order}
+
+	switch v := entry.Attribute(AttrLocation).(type) {
+	case uint64:
+		expr, err := d.locListEntry(v, pc)
+		if err != nil {
+			return nil, err
+		}
+		return evalExpression(expr, info, regs, mem)
+	case int64:
+		expr, err := d.locListEntry(uint64(v), pc)
+		if err != nil {
+			return nil, err
+		}
+		return evalExpression(expr, info, regs, mem)
+	}
 
-	loclist, ok := entry.Attribute(AttrLocation).([]byte)
+	expr, ok := entry.Attribute(AttrLocation).([]byte)
 
 	if !ok {
-		return 0, fmt.Errorf("No AttrLocation in Entry")
+		return nil, fmt.Errorf("No AttrLocation in Entry")
 	}
 
-	return parseLocList(loclist, locInfo{CanonicalFrameAddress: cfa})
+	return evalExpression(expr, info, regs, mem)
 }
@@ -0,0 +1,418 @@
+package dwarf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	dw_LNS_copy               = 0x01
+	dw_LNS_advance_pc         = 0x02
+	dw_LNS_advance_line       = 0x03
+	dw_LNS_set_file           = 0x04
+	dw_LNS_set_column         = 0x05
+	dw_LNS_negate_stmt        = 0x06
+	dw_LNS_set_basic_block    = 0x07
+	dw_LNS_const_add_pc       = 0x08
+	dw_LNS_fixed_advance_pc   = 0x09
+	dw_LNS_set_prologue_end   = 0x0a
+	dw_LNS_set_epilogue_begin = 0x0b
+	dw_LNS_set_isa            = 0x0c
+
+	dw_LNE_end_sequence      = 0x01
+	dw_LNE_set_address       = 0x02
+	dw_LNE_define_file       = 0x03
+	dw_LNE_set_discriminator = 0x04
+)
+
+// LineEntry is one row of a compilation unit's line-number program: it
+// says that, starting at PC, execution is at File:Line:Column, until
+// the next LineEntry for the same sequence (or, if EndSequence is
+// true, that PC is just past the end of the sequence and doesn't map
+// to any source location).
+type LineEntry struct {
+	PC          uintptr
+	File        string
+	Line        int
+	Column      int
+	IsStmt      bool
+	EndSequence bool
+}
+
+// lineProgFile is one entry of a line-number program's file_names
+// table (DWARF �6.2.4).
+type lineProgFile struct {
+	Name     string
+	DirIndex uint64
+}
+
+// ensureLineEntries parses d.line, the concatenation of every
+// compilation unit's line-number program, the first time it's needed
+// and caches the result (and any error) for later calls.
+func (d *Data) ensureLineEntries() error {
+	if d.lineEntries != nil || d.lineErr != nil {
+		return d.lineErr
+	}
+
+	entries, err := parseLinePrograms(d.line, d.order)
+	if err != nil {
+		d.lineErr = err
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].PC < entries[j].PC })
+
+	d.lineEntries = entries
+	return nil
+}
+
+// PCToLine reports the source location pc maps to, per .debug_line.
+func (d *Data) PCToLine(pc uintptr) (file string, line int, ok bool) {
+	if err := d.ensureLineEntries(); err != nil {
+		return "", 0, false
+	}
+
+	entries := d.lineEntries
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].PC > pc }) - 1
+	if i < 0 || entries[i].EndSequence {
+		return "", 0, false
+	}
+
+	return entries[i].File, entries[i].Line, true
+}
+
+// LineToPCs reports every pc the line-number program says maps to
+// file:line.
+func (d *Data) LineToPCs(file string, line int) []uintptr {
+	if err := d.ensureLineEntries(); err != nil {
+		return nil
+	}
+
+	var pcs []uintptr
+	for _, e := range d.lineEntries {
+		if !e.EndSequence && e.File == file && e.Line == line {
+			pcs = append(pcs, e.PC)
+		}
+	}
+
+	return pcs
+}
+
+// parseLinePrograms runs every line-number program packed into data
+// (one per compilation unit, back to back) and returns their rows
+// concatenated.
+func parseLinePrograms(data []byte, order binary.ByteOrder) ([]LineEntry, error) {
+	if order == nil {
+		order = binary.LittleEndian
+	}
+
+	var entries []LineEntry
+
+	stream := bytes.NewReader(data)
+	for stream.Len() > 0 {
+		rows, err := parseLineProgram(stream, order)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, rows...)
+	}
+
+	return entries, nil
+}
+
+// parseLineProgram parses one compilation unit's line-number program
+// (DWARF v2-v4, �6.2) from stream, leaving stream positioned at the
+// start of the next one.
+func parseLineProgram(stream *bytes.Reader, order binary.ByteOrder) ([]LineEntry, error) {
+	unitLength, is64, err := readInitialLength(stream, order)
+	if err != nil {
+		return nil, err
+	}
+
+	unit := make([]byte, unitLength)
+	if _, err := io.ReadFull(stream, unit); err != nil {
+		return nil, err
+	}
+	body := bytes.NewReader(unit)
+
+	var version uint16
+	if err := binary.Read(body, order, &version); err != nil {
+		return nil, err
+	}
+	if version < 2 || version > 4 {
+		return nil, fmt.Errorf("dwarf: unsupported line number program version: %d", version)
+	}
+
+	headerLength, err := readSectionOffset(body, order, is64)
+	if err != nil {
+		return nil, err
+	}
+	programStart := body.Len() - int(headerLength)
+
+	minInstrLen, err := body.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	maxOpsPerInstr := byte(1)
+	if version >= 4 {
+		maxOpsPerInstr, err = body.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	defaultIsStmtByte, err := body.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	defaultIsStmt := defaultIsStmtByte != 0
+
+	lineBaseByte, err := body.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	lineBase := int8(lineBaseByte)
+
+	lineRange, err := body.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	opcodeBase, err := body.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	standardOpcodeLengths := make([]byte, opcodeBase-1)
+	if _, err := io.ReadFull(body, standardOpcodeLengths); err != nil {
+		return nil, err
+	}
+
+	var includeDirs []string
+	for {
+		s, err := readCString(body)
+		if err != nil {
+			return nil, err
+		}
+		if s == "" {
+			break
+		}
+		includeDirs = append(includeDirs, s)
+	}
+
+	var files []lineProgFile
+	files = append(files, lineProgFile{}) // file index 0 is unused by DWARF2-4
+	for {
+		name, err := readCString(body)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			break
+		}
+
+		dirIndex, err := parseUnsignedLEB128(body)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := parseUnsignedLEB128(body); err != nil { // mtime
+			return nil, err
+		}
+		if _, err := parseUnsignedLEB128(body); err != nil { // length
+			return nil, err
+		}
+
+		files = append(files, lineProgFile{Name: name, DirIndex: dirIndex})
+	}
+
+	if skip := programStart - body.Len(); skip > 0 {
+		if _, err := body.Seek(int64(skip), io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+
+	fileName := func(i uint64) string {
+		if i < uint64(len(files)) {
+			return files[i].Name
+		}
+		return ""
+	}
+
+	var rows []LineEntry
+
+	address := uint64(0)
+	opIndex := uint64(0)
+	file := uint64(1)
+	line := 1
+	column := 0
+	isStmt := defaultIsStmt
+
+	reset := func() {
+		address, opIndex = 0, 0
+		file, line, column = 1, 1, 0
+		isStmt = defaultIsStmt
+	}
+
+	emit := func(endSequence bool) {
+		rows = append(rows, LineEntry{
+			PC:          uintptr(address),
+			File:        fileName(file),
+			Line:        line,
+			Column:      column,
+			IsStmt:      isStmt,
+			EndSequence: endSequence,
+		})
+	}
+
+	advance := func(operationAdvance uint64) {
+		if maxOpsPerInstr <= 1 {
+			address += uint64(minInstrLen) * operationAdvance
+			return
+		}
+		address += uint64(minInstrLen) * ((opIndex + operationAdvance) / uint64(maxOpsPerInstr))
+		opIndex = (opIndex + operationAdvance) % uint64(maxOpsPerInstr)
+	}
+
+	for {
+		opcode, err := body.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case opcode == 0:
+			length, err := parseUnsignedLEB128(body)
+			if err != nil {
+				return nil, err
+			}
+			extended := make([]byte, length)
+			if _, err := io.ReadFull(body, extended); err != nil {
+				return nil, err
+			}
+			ext := bytes.NewReader(extended)
+
+			sub, err := ext.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+
+			switch sub {
+			case dw_LNE_end_sequence:
+				emit(true)
+				reset()
+
+			case dw_LNE_set_address:
+				var addr uint64
+				if err := binary.Read(ext, order, &addr); err != nil {
+					return nil, err
+				}
+				address, opIndex = addr, 0
+
+			case dw_LNE_define_file:
+				name, err := readCString(ext)
+				if err != nil {
+					return nil, err
+				}
+				dirIndex, err := parseUnsignedLEB128(ext)
+				if err != nil {
+					return nil, err
+				}
+				files = append(files, lineProgFile{Name: name, DirIndex: dirIndex})
+
+			case dw_LNE_set_discriminator:
+				if _, err := parseUnsignedLEB128(ext); err != nil {
+					return nil, err
+				}
+
+			default:
+				// Vendor extension we don't understand; we've already
+				// consumed exactly `length` bytes, so just move on.
+			}
+
+		case opcode < opcodeBase:
+			switch opcode {
+			case dw_LNS_copy:
+				emit(false)
+
+			case dw_LNS_advance_pc:
+				n, err := parseUnsignedLEB128(body)
+				if err != nil {
+					return nil, err
+				}
+				advance(n)
+
+			case dw_LNS_advance_line:
+				n, err := parseSignedLEB128(body)
+				if err != nil {
+					return nil, err
+				}
+				line += int(n)
+
+			case dw_LNS_set_file:
+				n, err := parseUnsignedLEB128(body)
+				if err != nil {
+					return nil, err
+				}
+				file = n
+
+			case dw_LNS_set_column:
+				n, err := parseUnsignedLEB128(body)
+				if err != nil {
+					return nil, err
+				}
+				column = int(n)
+
+			case dw_LNS_negate_stmt:
+				isStmt = !isStmt
+
+			case dw_LNS_set_basic_block:
+				// We don't expose basic-block boundaries; nothing to do.
+
+			case dw_LNS_const_add_pc:
+				adjusted := 255 - int(opcodeBase)
+				advance(uint64(adjusted / int(lineRange)))
+
+			case dw_LNS_fixed_advance_pc:
+				var delta uint16
+				if err := binary.Read(body, order, &delta); err != nil {
+					return nil, err
+				}
+				address += uint64(delta)
+				opIndex = 0
+
+			case dw_LNS_set_prologue_end, dw_LNS_set_epilogue_begin:
+				// We don't expose these; nothing to do.
+
+			case dw_LNS_set_isa:
+				if _, err := parseUnsignedLEB128(body); err != nil {
+					return nil, err
+				}
+
+			default:
+				// A standard opcode we don't recognize (a future DWARF
+				// version); standardOpcodeLengths tells us how many
+				// ULEB128 operands to discard to stay in sync.
+				for i := byte(0); i < standardOpcodeLengths[opcode-1]; i++ {
+					if _, err := parseUnsignedLEB128(body); err != nil {
+						return nil, err
+					}
+				}
+			}
+
+		default:
+			adjusted := int(opcode) - int(opcodeBase)
+			advance(uint64(adjusted / int(lineRange)))
+			line += int(lineBase) + adjusted%int(lineRange)
+			emit(false)
+		}
+	}
+
+	return rows, nil
+}
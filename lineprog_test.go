@@ -0,0 +1,88 @@
+package dwarf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// buildLineProgram assembles a minimal DWARF v4 line-number program
+// for one compilation unit: DW_LNE_set_address to addr, a file/line
+// row via DW_LNS_copy, then DW_LNE_end_sequence.
+func buildLineProgram(addr uint64, file string, line int) []byte {
+	var header bytes.Buffer
+	header.WriteByte(1)            // minimum_instruction_length
+	header.WriteByte(1)            // maximum_operations_per_instruction
+	header.WriteByte(1)            // default_is_stmt
+	header.WriteByte(0xfb)         // line_base = -5
+	header.WriteByte(14)           // line_range
+	header.WriteByte(13)           // opcode_base
+	header.Write(make([]byte, 12)) // standard_opcode_lengths (unused by this program)
+	header.WriteByte(0)            // include_directories terminator
+	header.WriteString(file)       // file_names[1].name
+	header.WriteByte(0)
+	buildULEB128(&header, 0) // dir_index
+	buildULEB128(&header, 0) // mtime
+	buildULEB128(&header, 0) // length
+	header.WriteByte(0)      // file_names terminator
+
+	var prog bytes.Buffer
+	prog.WriteByte(0) // extended opcode marker
+	buildULEB128(&prog, 9)
+	prog.WriteByte(dw_LNE_set_address)
+	binary.Write(&prog, binary.LittleEndian, addr)
+
+	// DW_LNS_advance_line (SLEB128 line-1, since line starts at 1), then DW_LNS_copy.
+	prog.WriteByte(dw_LNS_advance_line)
+	buildSLEB128(&prog, int64(line-1))
+	prog.WriteByte(dw_LNS_copy)
+
+	prog.WriteByte(0) // extended opcode marker
+	buildULEB128(&prog, 1)
+	prog.WriteByte(dw_LNE_end_sequence)
+
+	var unit bytes.Buffer
+	binary.Write(&unit, binary.LittleEndian, uint16(4)) // version
+	binary.Write(&unit, binary.LittleEndian, uint32(header.Len()))
+	unit.Write(header.Bytes())
+	unit.Write(prog.Bytes())
+
+	var out bytes.Buffer
+	binary.Write(&out, binary.LittleEndian, uint32(unit.Len()))
+	out.Write(unit.Bytes())
+
+	return out.Bytes()
+}
+
+// TestParseLineProgram makes sure a line-number program's rows decode
+// to the file/line/address they encode.
+func TestParseLineProgram(t *testing.T) {
+	const addr = 0x4000
+	const wantFile = "main.go"
+	const wantLine = 42
+
+	entries, err := parseLinePrograms(buildLineProgram(addr, wantFile, wantLine), binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var row *LineEntry
+	for i := range entries {
+		if !entries[i].EndSequence {
+			row = &entries[i]
+		}
+	}
+	if row == nil {
+		t.Fatal("no non-EndSequence row found")
+	}
+
+	if row.PC != addr {
+		t.Errorf("PC = %#x, want %#x", row.PC, addr)
+	}
+	if row.File != wantFile {
+		t.Errorf("File = %q, want %q", row.File, wantFile)
+	}
+	if row.Line != wantLine {
+		t.Errorf("Line = %d, want %d", row.Line, wantLine)
+	}
+}
@@ -2,7 +2,9 @@ package dwarf
 
 import (
 	"github.com/mitchellh/osext"
+	"debug/elf"
 	"debug/macho"
+	"runtime"
 )
 
 func LoadForSelf() (*Data, error) {
@@ -13,33 +15,110 @@ func LoadForSelf() (*Data, error) {
 		return nil, err
 	}
 
-	file, err := macho.Open(path)
+	// Mach-O and ELF use unrelated section-naming conventions, so we
+	// have to pick a loader based on the platform we're actually
+	// running on rather than sniffing the file.
+	if runtime.GOOS == "darwin" {
+		file, err := macho.Open(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return LoadFromMachO(file)
+	}
+
+	file, err := elf.Open(path)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return LoadFromMachO(file)
+	return LoadFromELF(file)
 }
 
 func LoadFromMachO(f *macho.File) (*Data, error) {
-	var names = [...]string{"abbrev", "info", "str", "frame"}
-    var dat [len(names)][]byte
-    for i, name := range names {
-        name = "__debug_" + name
-        s := f.Section(name)
-        if s == nil {
-            dat[i] = []byte{}
-            continue
-        }
-        b, err := s.Data()
-        if err != nil && uint64(len(b)) < s.Size {
-            return nil, err
-        }
-        dat[i] = b
-    }
-
-    abbrev, info, str, frame := dat[0], dat[1], dat[2], dat[3]
-
-    return New(abbrev, nil, frame, info, nil, nil, nil, str)
+	var names = [...]string{"abbrev", "info", "str", "frame", "line"}
+	var dat [len(names)][]byte
+	for i, name := range names {
+		name = "__debug_" + name
+		s := f.Section(name)
+		if s == nil {
+			dat[i] = []byte{}
+			continue
+		}
+		b, err := s.Data()
+		if err != nil && uint64(len(b)) < s.Size {
+			return nil, err
+		}
+		dat[i] = b
+	}
+
+	abbrev, info, str, frame, line := dat[0], dat[1], dat[2], dat[3], dat[4]
+
+	d, err := New(abbrev, nil, frame, info, line, nil, nil, str)
+
+	if err != nil {
+		return nil, err
+	}
+
+	d.order = f.ByteOrder
+	d.line = line
+
+	if len(frame) == 0 {
+		if s := f.Section("__eh_frame"); s != nil {
+			ehFrame, err := s.Data()
+			if err != nil && uint64(len(ehFrame)) < s.Size {
+				return nil, err
+			}
+			d.LoadEHFrame(ehFrame, uintptr(s.Addr))
+		}
+	}
+
+	return d, nil
+}
+
+// LoadFromELF reads DWARF debug sections out of an ELF binary, the
+// standard layout produced by gcc/clang/gc on Linux and FreeBSD, and
+// builds a *Data the same way LoadFromMachO does for Mach-O binaries.
+func LoadFromELF(f *elf.File) (*Data, error) {
+	var names = [...]string{"abbrev", "info", "str", "frame", "line", "ranges", "loc"}
+	var dat [len(names)][]byte
+	for i, name := range names {
+		name = ".debug_" + name
+		s := f.Section(name)
+		if s == nil {
+			dat[i] = []byte{}
+			continue
+		}
+		b, err := s.Data()
+		if err != nil && uint64(len(b)) < s.Size {
+			return nil, err
+		}
+		dat[i] = b
+	}
+
+	abbrev, info, str, frame, line, ranges, loc := dat[0], dat[1], dat[2], dat[3], dat[4], dat[5], dat[6]
+
+	d, err := New(abbrev, nil, frame, info, line, nil, ranges, str)
+
+	if err != nil {
+		return nil, err
+	}
+
+	d.order = f.ByteOrder
+	d.loc = loc
+	d.line = line
+
+	if len(frame) == 0 {
+		if s := f.Section(".eh_frame"); s != nil {
+			ehFrame, err := s.Data()
+			if err != nil && uint64(len(ehFrame)) < s.Size {
+				return nil, err
+			}
+			d.LoadEHFrame(ehFrame, uintptr(s.Addr))
+		}
+	}
+
+	return d, nil
 }
@@ -0,0 +1,50 @@
+package dwarf
+
+import "testing"
+
+// TestNewPopulatesData makes sure New actually wires each section
+// argument through to the Data it returns, since every loader in
+// load.go depends on that to do anything useful.
+func TestNewPopulatesData(t *testing.T) {
+	abbrev := []byte{1}
+	aranges := []byte{2}
+	frame := []byte{3}
+	info := []byte{4}
+	line := []byte{5}
+	pubnames := []byte{6}
+	ranges := []byte{7}
+	str := []byte{8}
+
+	d, err := New(abbrev, aranges, frame, info, line, pubnames, ranges, str)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(d.abbrev) != string(abbrev) {
+		t.Errorf("abbrev = %v, want %v", d.abbrev, abbrev)
+	}
+	if string(d.aranges) != string(aranges) {
+		t.Errorf("aranges = %v, want %v", d.aranges, aranges)
+	}
+	if string(d.frame) != string(frame) {
+		t.Errorf("frame = %v, want %v", d.frame, frame)
+	}
+	if string(d.info) != string(info) {
+		t.Errorf("info = %v, want %v", d.info, info)
+	}
+	if string(d.line) != string(line) {
+		t.Errorf("line = %v, want %v", d.line, line)
+	}
+	if string(d.pubnames) != string(pubnames) {
+		t.Errorf("pubnames = %v, want %v", d.pubnames, pubnames)
+	}
+	if string(d.ranges) != string(ranges) {
+		t.Errorf("ranges = %v, want %v", d.ranges, ranges)
+	}
+	if string(d.str) != string(str) {
+		t.Errorf("str = %v, want %v", d.str, str)
+	}
+	if d.order == nil {
+		t.Error("order was left nil")
+	}
+}
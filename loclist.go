@@ -2,13 +2,15 @@ package dwarf
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
-	"log"
 )
 
 type locInfo struct {
 	CanonicalFrameAddress uintptr
+	Order                 binary.ByteOrder
 }
 
 const (
@@ -188,57 +190,807 @@ const (
 	dw_LEB_BITS      = 0xff ^ dw_LEB_EXTENSION
 )
 
-func parseLocList(locList []byte, info locInfo) (addr uintptr, err error) {
+// Location is the result of evaluating a DWARF location expression.
+// It is always one of InMemory, InRegister, Composite, or
+// ImplicitValue.
+type Location interface {
+	isLocation()
+}
+
+// InMemory says the value lives at a fixed address.
+type InMemory struct {
+	Address uintptr
+}
+
+// InRegister says the value lives in DWARF register Register, not in
+// memory at all.
+type InRegister struct {
+	Register uint64
+}
+
+// Composite says the value is assembled from several pieces, each
+// potentially living somewhere different (and, for a piece with a nil
+// Location, nowhere - the piece was optimized out).
+type Composite struct {
+	Pieces []Piece
+}
+
+// ImplicitValue says the value isn't stored anywhere at all; Value
+// holds it directly, little-endian.
+type ImplicitValue struct {
+	Value []byte
+}
+
+func (InMemory) isLocation()      {}
+func (InRegister) isLocation()    {}
+func (Composite) isLocation()     {}
+func (ImplicitValue) isLocation() {}
+
+// Piece is one fragment of a Composite location, produced by
+// DW_OP_piece/DW_OP_bit_piece. Exactly one of Size (a whole number of
+// bytes) or BitSize+BitOffset (a bitfield) is meaningful, matching
+// which opcode produced it.
+type Piece struct {
+	Size      int64
+	BitSize   int64
+	BitOffset int64
+	Location  Location
+}
+
+// parseLocList evaluates a single DWARF location expression and
+// reduces it to a memory address or constant value, for callers that
+// have no Registers/MemReader of their own to evaluate it against.
+func parseLocList(locList []byte, info locInfo) (uintptr, error) {
+	return evalLocationAddress(locList, info, nil, nil)
+}
+
+// evalLocationAddress is parseLocList, but driven by a real regs/mem
+// pair rather than always evaluating in a vacuum - for CFA and
+// register rules (DW_CFA_def_cfa_expression, DW_CFA_expression,
+// DW_CFA_val_expression), which commonly reference other registers
+// (DW_OP_bregN) and so need the same Registers/MemReader the CFI
+// interpreter itself was given.
+func evalLocationAddress(expr []byte, info locInfo, regs Registers, mem MemReader) (uintptr, error) {
+	loc, err := evalExpression(expr, info, regs, mem)
+	if err != nil {
+		return 0, err
+	}
+
+	switch l := loc.(type) {
+	case InMemory:
+		return l.Address, nil
+	case ImplicitValue:
+		return uintptr(decodeInt64(l.Value)), nil
+	default:
+		return 0, fmt.Errorf("dwarf: location expression did not produce an address or value: %T", loc)
+	}
+}
 
-	var stack []int64
+// evalExpression runs a DWARF v4 location expression (�2.5) and
+// returns the Location it describes. regs and mem may be nil if expr
+// is known not to need register or memory access; an expression that
+// turns out to need them anyway reports an error rather than panicking.
+func evalExpression(expr []byte, info locInfo, regs Registers, mem MemReader) (Location, error) {
+	order := info.Order
+	if order == nil {
+		order = binary.LittleEndian
+	}
+
+	vm := &exprVM{
+		stream: bytes.NewReader(expr),
+		order:  order,
+		info:   info,
+		regs:   regs,
+		mem:    mem,
+	}
+
+	if err := vm.run(); err != nil {
+		return nil, err
+	}
+
+	return vm.result()
+}
 
-	stream := bytes.NewReader(locList)
+// exprVM is the state of one DWARF expression evaluation: an integer
+// stack, any pieces assembled so far by DW_OP_piece/DW_OP_bit_piece,
+// and whether the top of the (current piece's) stack is a value
+// (DW_OP_stack_value) or an implicit value (DW_OP_implicit_value)
+// rather than an address.
+type exprVM struct {
+	stream *bytes.Reader
+	order  binary.ByteOrder
+	info   locInfo
+	regs   Registers
+	mem    MemReader
 
+	stack         []int64
+	pieces        []Piece
+	isValue       bool
+	implicitBytes []byte
+	regResult     *uint64
+}
+
+func (vm *exprVM) push(v int64) {
+	vm.stack = append(vm.stack, v)
+}
+
+func (vm *exprVM) pop() (int64, error) {
+	if len(vm.stack) == 0 {
+		return 0, errors.New("dwarf: location expression stack underflow")
+	}
+	v := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return v, nil
+}
+
+func (vm *exprVM) top() (int64, error) {
+	if len(vm.stack) == 0 {
+		return 0, errors.New("dwarf: location expression stack underflow")
+	}
+	return vm.stack[len(vm.stack)-1], nil
+}
+
+func (vm *exprVM) reg(col uint64) (int64, error) {
+	if vm.regs == nil {
+		return 0, fmt.Errorf("dwarf: location expression reads register %d but no Registers was given", col)
+	}
+	v, err := vm.regs.Reg(col)
+	return int64(v), err
+}
+
+func (vm *exprVM) readMem(addr uintptr, size int) (int64, error) {
+	if vm.mem == nil {
+		return 0, fmt.Errorf("dwarf: location expression dereferences memory but no MemReader was given")
+	}
+
+	buf := make([]byte, size)
+	if _, err := vm.mem.ReadAt(buf, int64(addr)); err != nil {
+		return 0, err
+	}
+
+	switch size {
+	case 1:
+		return int64(buf[0]), nil
+	case 2:
+		return int64(order16(vm.order, buf)), nil
+	case 4:
+		return int64(order32(vm.order, buf)), nil
+	case 8:
+		return int64(order64(vm.order, buf)), nil
+	default:
+		var v uint64
+		for i, b := range buf {
+			if vm.order == binary.BigEndian {
+				v = v<<8 | uint64(b)
+			} else {
+				v |= uint64(b) << (8 * uint(i))
+			}
+		}
+		return int64(v), nil
+	}
+}
+
+func order16(order binary.ByteOrder, b []byte) uint16 { return order.Uint16(b) }
+func order32(order binary.ByteOrder, b []byte) uint32 { return order.Uint32(b) }
+func order64(order binary.ByteOrder, b []byte) uint64 { return order.Uint64(b) }
+
+// currentLocation reports the Location the VM's state currently
+// describes, used both when a piece boundary is reached and at the end
+// of the expression. It returns nil if there is nothing to report
+// (an empty stack, meaning an optimized-out piece).
+func (vm *exprVM) currentLocation() Location {
+	switch {
+	case vm.implicitBytes != nil:
+		return ImplicitValue{Value: vm.implicitBytes}
+	case vm.regResult != nil:
+		return InRegister{Register: *vm.regResult}
+	case len(vm.stack) == 0:
+		return nil
+	case vm.isValue:
+		return ImplicitValue{Value: encodeInt64(vm.stack[len(vm.stack)-1])}
+	default:
+		return InMemory{Address: uintptr(vm.stack[len(vm.stack)-1])}
+	}
+}
+
+func (vm *exprVM) finishPiece(size, bitSize, bitOffset int64) {
+	vm.pieces = append(vm.pieces, Piece{
+		Size:      size,
+		BitSize:   bitSize,
+		BitOffset: bitOffset,
+		Location:  vm.currentLocation(),
+	})
+
+	vm.stack = nil
+	vm.isValue = false
+	vm.implicitBytes = nil
+	vm.regResult = nil
+}
+
+func (vm *exprVM) result() (Location, error) {
+	if len(vm.pieces) > 0 {
+		return Composite{Pieces: vm.pieces}, nil
+	}
+
+	if loc := vm.currentLocation(); loc != nil {
+		if !vm.isValue && vm.implicitBytes == nil && vm.regResult == nil && len(vm.stack) != 1 {
+			return nil, errors.New("dwarf: location expression did not leave exactly one value on the stack")
+		}
+		return loc, nil
+	}
+
+	return nil, errors.New("dwarf: location expression produced no result")
+}
+
+func (vm *exprVM) run() error {
 	for {
-		log.Println("Stack: %%", stack)
-		instruction, err := stream.ReadByte()
+		instruction, err := vm.stream.ReadByte()
 		if err == io.EOF {
-			break
+			return nil
 		}
 		if err != nil {
-			return 0, err
+			return err
+		}
+
+		switch {
+		case instruction >= dw_OP_lit0 && instruction <= dw_OP_lit31:
+			vm.push(int64(instruction - dw_OP_lit0))
+			continue
+
+		case instruction >= dw_OP_reg0 && instruction <= dw_OP_reg31:
+			col := uint64(instruction - dw_OP_reg0)
+			vm.regResult = &col
+			continue
+
+		case instruction >= dw_OP_breg0 && instruction <= dw_OP_breg31:
+			col := uint64(instruction - dw_OP_breg0)
+			off, err := parseSignedLEB128(vm.stream)
+			if err != nil {
+				return err
+			}
+			v, err := vm.reg(col)
+			if err != nil {
+				return err
+			}
+			vm.push(v + off)
+			continue
 		}
 
 		switch instruction {
+		case dw_OP_addr:
+			var addr uint64
+			if err := binary.Read(vm.stream, vm.order, &addr); err != nil {
+				return err
+			}
+			vm.push(int64(addr))
+
+		case dw_OP_const1u:
+			b, err := vm.stream.ReadByte()
+			if err != nil {
+				return err
+			}
+			vm.push(int64(b))
+
+		case dw_OP_const1s:
+			b, err := vm.stream.ReadByte()
+			if err != nil {
+				return err
+			}
+			vm.push(int64(int8(b)))
+
+		case dw_OP_const2u:
+			var v uint16
+			if err := binary.Read(vm.stream, vm.order, &v); err != nil {
+				return err
+			}
+			vm.push(int64(v))
+
+		case dw_OP_const2s:
+			var v int16
+			if err := binary.Read(vm.stream, vm.order, &v); err != nil {
+				return err
+			}
+			vm.push(int64(v))
+
+		case dw_OP_const4u:
+			var v uint32
+			if err := binary.Read(vm.stream, vm.order, &v); err != nil {
+				return err
+			}
+			vm.push(int64(v))
+
+		case dw_OP_const4s:
+			var v int32
+			if err := binary.Read(vm.stream, vm.order, &v); err != nil {
+				return err
+			}
+			vm.push(int64(v))
+
+		case dw_OP_const8u:
+			var v uint64
+			if err := binary.Read(vm.stream, vm.order, &v); err != nil {
+				return err
+			}
+			vm.push(int64(v))
+
+		case dw_OP_const8s:
+			var v int64
+			if err := binary.Read(vm.stream, vm.order, &v); err != nil {
+				return err
+			}
+			vm.push(v)
+
+		case dw_OP_constu:
+			n, err := parseUnsignedLEB128(vm.stream)
+			if err != nil {
+				return err
+			}
+			vm.push(int64(n))
+
 		case dw_OP_consts:
+			n, err := parseSignedLEB128(vm.stream)
+			if err != nil {
+				return err
+			}
+			vm.push(n)
 
-			n, err := parseSignedLEB128(stream)
+		case dw_OP_dup:
+			v, err := vm.top()
 			if err != nil {
-				return 0, err
+				return err
+			}
+			vm.push(v)
+
+		case dw_OP_drop:
+			if _, err := vm.pop(); err != nil {
+				return err
+			}
+
+		case dw_OP_over:
+			if len(vm.stack) < 2 {
+				return errors.New("dwarf: location expression stack underflow")
 			}
+			vm.push(vm.stack[len(vm.stack)-2])
 
-			stack = append(stack, n)
+		case dw_OP_pick:
+			idx, err := vm.stream.ReadByte()
+			if err != nil {
+				return err
+			}
+			if int(idx) >= len(vm.stack) {
+				return errors.New("dwarf: location expression stack underflow")
+			}
+			vm.push(vm.stack[len(vm.stack)-1-int(idx)])
+
+		case dw_OP_swap:
+			if len(vm.stack) < 2 {
+				return errors.New("dwarf: location expression stack underflow")
+			}
+			n := len(vm.stack)
+			vm.stack[n-1], vm.stack[n-2] = vm.stack[n-2], vm.stack[n-1]
+
+		case dw_OP_rot:
+			if len(vm.stack) < 3 {
+				return errors.New("dwarf: location expression stack underflow")
+			}
+			n := len(vm.stack)
+			vm.stack[n-1], vm.stack[n-2], vm.stack[n-3] = vm.stack[n-2], vm.stack[n-3], vm.stack[n-1]
+
+		case dw_OP_abs:
+			v, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			if v < 0 {
+				v = -v
+			}
+			vm.push(v)
+
+		case dw_OP_and:
+			b, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			a, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			vm.push(a & b)
+
+		case dw_OP_div:
+			b, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			a, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			if b == 0 {
+				return errors.New("dwarf: location expression divides by zero")
+			}
+			vm.push(int64(uint64(a) / uint64(b)))
+
+		case dw_OP_minus:
+			b, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			a, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			vm.push(a - b)
+
+		case dw_OP_mod:
+			b, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			a, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			if b == 0 {
+				return errors.New("dwarf: location expression divides by zero")
+			}
+			vm.push(int64(uint64(a) % uint64(b)))
+
+		case dw_OP_mul:
+			b, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			a, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			vm.push(a * b)
+
+		case dw_OP_neg:
+			v, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			vm.push(-v)
+
+		case dw_OP_not:
+			v, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			vm.push(^v)
+
+		case dw_OP_or:
+			b, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			a, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			vm.push(a | b)
 
 		case dw_OP_plus:
+			b, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			a, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			vm.push(a + b)
 
-			if len(stack) < 2 {
-				return 0, errors.New("Invalid location list")
+		case dw_OP_plus_uconst:
+			n, err := parseUnsignedLEB128(vm.stream)
+			if err != nil {
+				return err
 			}
+			a, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			vm.push(a + int64(n))
 
-			a := stack[len(stack)-1]
-			b := stack[len(stack)-2]
+		case dw_OP_shl:
+			b, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			a, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			vm.push(a << uint(b))
 
-			stack = append(stack[:len(stack)-2], a+b)
+		case dw_OP_shr:
+			b, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			a, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			vm.push(int64(uint64(a) >> uint(b)))
+
+		case dw_OP_shra:
+			b, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			a, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			vm.push(a >> uint(b))
+
+		case dw_OP_xor:
+			b, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			a, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			vm.push(a ^ b)
+
+		case dw_OP_eq, dw_OP_ne, dw_OP_lt, dw_OP_le, dw_OP_gt, dw_OP_ge:
+			b, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			a, err := vm.pop()
+			if err != nil {
+				return err
+			}
+
+			var result bool
+			switch instruction {
+			case dw_OP_eq:
+				result = a == b
+			case dw_OP_ne:
+				result = a != b
+			case dw_OP_lt:
+				result = a < b
+			case dw_OP_le:
+				result = a <= b
+			case dw_OP_gt:
+				result = a > b
+			case dw_OP_ge:
+				result = a >= b
+			}
+
+			if result {
+				vm.push(1)
+			} else {
+				vm.push(0)
+			}
+
+		case dw_OP_skip, dw_OP_bra:
+			var delta int16
+			if err := binary.Read(vm.stream, vm.order, &delta); err != nil {
+				return err
+			}
+
+			jump := instruction == dw_OP_skip
+			if !jump {
+				v, err := vm.pop()
+				if err != nil {
+					return err
+				}
+				jump = v != 0
+			}
+
+			if jump {
+				if _, err := vm.stream.Seek(int64(delta), io.SeekCurrent); err != nil {
+					return err
+				}
+			}
+
+		case dw_OP_deref:
+			addr, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			v, err := vm.readMem(uintptr(addr), 8)
+			if err != nil {
+				return err
+			}
+			vm.push(v)
+
+		case dw_OP_deref_size:
+			size, err := vm.stream.ReadByte()
+			if err != nil {
+				return err
+			}
+			addr, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			v, err := vm.readMem(uintptr(addr), int(size))
+			if err != nil {
+				return err
+			}
+			vm.push(v)
+
+		case dw_OP_xderef:
+			if _, err := vm.pop(); err != nil { // address space identifier; we don't model multiple spaces
+				return err
+			}
+			addr, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			v, err := vm.readMem(uintptr(addr), 8)
+			if err != nil {
+				return err
+			}
+			vm.push(v)
+
+		case dw_OP_xderef_size:
+			size, err := vm.stream.ReadByte()
+			if err != nil {
+				return err
+			}
+			if _, err := vm.pop(); err != nil {
+				return err
+			}
+			addr, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			v, err := vm.readMem(uintptr(addr), int(size))
+			if err != nil {
+				return err
+			}
+			vm.push(v)
+
+		case dw_OP_fbreg:
+			off, err := parseSignedLEB128(vm.stream)
+			if err != nil {
+				return err
+			}
+			if vm.regs == nil {
+				return errors.New("dwarf: location expression uses DW_OP_fbreg but no Registers was given")
+			}
+			base, err := vm.regs.FrameBase()
+			if err != nil {
+				return err
+			}
+			vm.push(base + off)
+
+		case dw_OP_regx:
+			col, err := parseUnsignedLEB128(vm.stream)
+			if err != nil {
+				return err
+			}
+			vm.regResult = &col
+
+		case dw_OP_bregx:
+			col, err := parseUnsignedLEB128(vm.stream)
+			if err != nil {
+				return err
+			}
+			off, err := parseSignedLEB128(vm.stream)
+			if err != nil {
+				return err
+			}
+			v, err := vm.reg(col)
+			if err != nil {
+				return err
+			}
+			vm.push(v + off)
+
+		case dw_OP_piece:
+			size, err := parseUnsignedLEB128(vm.stream)
+			if err != nil {
+				return err
+			}
+			vm.finishPiece(int64(size), 0, 0)
+
+		case dw_OP_bit_piece:
+			size, err := parseUnsignedLEB128(vm.stream)
+			if err != nil {
+				return err
+			}
+			offset, err := parseUnsignedLEB128(vm.stream)
+			if err != nil {
+				return err
+			}
+			vm.finishPiece(0, int64(size), int64(offset))
+
+		case dw_OP_stack_value:
+			vm.isValue = true
+
+		case dw_OP_implicit_value:
+			block, err := readBlock(vm.stream)
+			if err != nil {
+				return err
+			}
+			vm.implicitBytes = block
 
 		case dw_OP_call_frame_cfa:
-			stack = append(stack, int64(info.CanonicalFrameAddress))
+			vm.push(int64(vm.info.CanonicalFrameAddress))
+
+		case dw_OP_nop:
+			// No-op.
 
 		default:
-			return 0, errors.New("Unsupported location OP")
+			return fmt.Errorf("dwarf: unsupported location expression opcode: %#x", instruction)
 		}
+	}
+}
 
+// locListEntry finds the location expression covering pc in the
+// .debug_loc list at offset, a sequence of (begin, end, expression)
+// entries terminated by a (0, 0) entry. A begin value of all-ones is a
+// base-address-selection entry: it doesn't cover any pc itself, but
+// sets end as the base every following entry's begin/end is relative
+// to, until the next such entry. This package has no DIE-tree walker,
+// so it has no way to know a compilation unit's low_pc to use as the
+// implicit base before the first explicit selection entry; base starts
+// at 0, which is only correct for a CU whose low_pc is itself 0.
+func (d *Data) locListEntry(offset uint64, pc uintptr) ([]byte, error) {
+	if offset >= uint64(len(d.loc)) {
+		return nil, fmt.Errorf("dwarf: location list offset %#x out of range", offset)
 	}
 
-	if len(stack) == 1 {
-		return uintptr(stack[0]), nil
-	} else {
-		return 0, errors.New("Invalid location list")
+	order := d.order
+	if order == nil {
+		order = binary.LittleEndian
 	}
+
+	stream := bytes.NewReader(d.loc[offset:])
+
+	var base uint64
+	for {
+		var begin, end uint64
+		if err := binary.Read(stream, order, &begin); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(stream, order, &end); err != nil {
+			return nil, err
+		}
+
+		if begin == 0 && end == 0 {
+			return nil, fmt.Errorf("dwarf: pc %#x not covered by location list at offset %#x", pc, offset)
+		}
+
+		if begin == ^uint64(0) {
+			base = end
+			continue
+		}
+
+		var length uint16
+		if err := binary.Read(stream, order, &length); err != nil {
+			return nil, err
+		}
+
+		expr := make([]byte, length)
+		if _, err := io.ReadFull(stream, expr); err != nil {
+			return nil, err
+		}
+
+		if base+begin <= uint64(pc) && uint64(pc) < base+end {
+			return expr, nil
+		}
+	}
+}
+
+func encodeInt64(v int64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(v))
+	return buf
+}
+
+func decodeInt64(b []byte) int64 {
+	var buf [8]byte
+	copy(buf[:], b)
+	return int64(binary.LittleEndian.Uint64(buf[:]))
 }
 
 // TODO: big.Int? check for overflow!
@@ -0,0 +1,51 @@
+package dwarf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// buildLocList assembles a synthetic .debug_loc list: a base-address-
+// selection entry establishing base, followed by one (begin, end, expr)
+// entry relative to it, terminated by the (0, 0) end marker.
+func buildLocList(base uint64, begin, end uint64, expr []byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, ^uint64(0)) // base-address-selection marker
+	binary.Write(&buf, binary.LittleEndian, base)
+	binary.Write(&buf, binary.LittleEndian, begin)
+	binary.Write(&buf, binary.LittleEndian, end)
+	binary.Write(&buf, binary.LittleEndian, uint16(len(expr)))
+	buf.Write(expr)
+	binary.Write(&buf, binary.LittleEndian, uint64(0))
+	binary.Write(&buf, binary.LittleEndian, uint64(0))
+	return buf.Bytes()
+}
+
+// TestLocListEntryUsesBaseAddressSelection makes sure a CU's
+// base-address-selection entry actually shifts where later entries'
+// begin/end are measured from, rather than being discarded: a list
+// whose selection entry sets base=0x10000 and whose range entry covers
+// [0x10, 0x20) relative to it should match pc 0x10015, not pc 0x15.
+func TestLocListEntryUsesBaseAddressSelection(t *testing.T) {
+	const base = 0x10000
+	want := []byte{1, 2, 3}
+
+	d, err := New(nil, nil, nil, nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.loc = buildLocList(base, 0x10, 0x20, want)
+
+	got, err := d.locListEntry(0, base+0x15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("locListEntry = %v, want %v", got, want)
+	}
+
+	if _, err := d.locListEntry(0, 0x15); err == nil {
+		t.Errorf("locListEntry(pc=0x15) unexpectedly matched, base-address-selection was ignored")
+	}
+}
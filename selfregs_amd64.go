@@ -0,0 +1,27 @@
+//go:build amd64
+
+package dwarf
+
+// ptrSize is the width of the return address CALL pushes, and so the
+// correction getSP's result needs to recover UnwindSelf's real SP.
+const ptrSize = 8
+
+// dw_reg_sp and dw_reg_bp are the DWARF register numbers for the stack
+// and frame pointers under the System V amd64 ABI, the one gc, gcc,
+// and clang all target.
+const dw_reg_sp = 7
+const dw_reg_bp = 6
+
+// getSP, getBP, and getPC (selfregs_amd64.s) read the CPU's SP, BP,
+// and PC registers as they stood in UnwindSelf's own frame. Go only
+// exposes these to code inside package runtime itself, so UnwindSelf
+// has to fetch them through these tiny assembly leaves instead.
+//
+//go:noescape
+func getSP() uintptr
+
+//go:noescape
+func getBP() uintptr
+
+//go:noescape
+func getPC() uintptr
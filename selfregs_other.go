@@ -0,0 +1,17 @@
+//go:build !amd64
+
+package dwarf
+
+// ptrSize, dw_reg_sp, and dw_reg_bp are unused on this build;
+// getSP/getBP/getPC below never return, so UnwindSelf never reaches
+// the code that needs them.
+const ptrSize = 0
+const dw_reg_sp = 0
+const dw_reg_bp = 0
+
+// getSP, getBP, and getPC have no implementation outside amd64:
+// reading a live goroutine's registers takes an assembly leaf per
+// architecture, and this package only has one for amd64 so far.
+func getSP() uintptr { panic("dwarf: UnwindSelf is not implemented on this architecture") }
+func getBP() uintptr { panic("dwarf: UnwindSelf is not implemented on this architecture") }
+func getPC() uintptr { panic("dwarf: UnwindSelf is not implemented on this architecture") }
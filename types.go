@@ -0,0 +1,83 @@
+package dwarf
+
+import "encoding/binary"
+
+// Offset identifies an Entry by its byte offset into .debug_info.
+type Offset uint32
+
+// Tag is a DWARF tag value (the DW_TAG_* constants, §7.5.3) saying
+// what kind of thing an Entry describes: a compile unit, a variable,
+// a subprogram, and so on.
+type Tag int
+
+// Attr is a DWARF attribute value (the DW_AT_* constants, §7.5.4)
+// identifying what a Field holds.
+type Attr int
+
+// A handful of commonly used attributes. Of these, only AttrLocation
+// is read by this package's own code (Entry.Location). Numeric values match the DWARF spec, so they agree with whatever
+// produced the .debug_abbrev/.debug_info this Attr is read out of.
+const (
+	AttrLocation  Attr = 0x02
+	AttrName      Attr = 0x03
+	AttrLowpc     Attr = 0x11
+	AttrHighpc    Attr = 0x12
+	AttrFrameBase Attr = 0x40
+)
+
+// Field is one (attribute, value) pair belonging to an Entry. Val's
+// dynamic type depends on Attr's form: most commonly []byte (a
+// location expression or other block), int64/uint64 (a constant or
+// section offset), or string.
+type Field struct {
+	Attr Attr
+	Val  interface{}
+}
+
+// Entry is one debugging information entry (DIE, §2.2): a tag saying
+// what it describes, and the attributes that describe it.
+type Entry struct {
+	Offset   Offset
+	Tag      Tag
+	Children bool
+	Field    []Field
+}
+
+// Data holds the debug sections extracted from one executable -
+// whichever of .debug_frame/.eh_frame is present for unwinding,
+// .debug_loc for location lists, .debug_line for the line-number
+// program, and the usual .debug_abbrev/.debug_info/.debug_str/etc for
+// walking the DIE tree - in whatever byte order the executable itself
+// used.
+type Data struct {
+	order binary.ByteOrder
+
+	abbrev, aranges, info, pubnames, ranges, str []byte
+
+	frame       []byte
+	ehFrame     []byte
+	ehFrameAddr uintptr
+	loc         []byte
+	line        []byte
+
+	lineEntries []LineEntry
+	lineErr     error
+}
+
+// New collects the raw bytes of an executable's debug sections into a
+// Data for the rest of this package to work from. It does no parsing
+// up front: each section is only interpreted the first time something
+// asks for the information it holds (FrameAt, PCToLine, ...).
+func New(abbrev, aranges, frame, info, line, pubnames, ranges, str []byte) (*Data, error) {
+	return &Data{
+		order:    binary.LittleEndian,
+		abbrev:   abbrev,
+		aranges:  aranges,
+		frame:    frame,
+		info:     info,
+		line:     line,
+		pubnames: pubnames,
+		ranges:   ranges,
+		str:      str,
+	}, nil
+}
@@ -3,6 +3,7 @@ package dwarf
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 )
@@ -35,98 +36,399 @@ const (
 	dw_CFA_lo_user = 0x1c
 	dw_CFA_hi_user = 0x3f
 
-	// Opcodes that take an addend operand.
+	// Opcodes that take their operand in the low 6 bits of the opcode
+	// byte itself, rather than as a following LEB128.
 	dw_CFA_advance_loc = 0x1 << 6 // +delta
 	dw_CFA_offset      = 0x2 << 6 // +register (ULEB128 offset)
 	dw_CFA_restore     = 0x3 << 6 // +register
 )
 
+// RegRuleKind identifies which form of DWARF's "register rule" (�6.4.1)
+// governs how to recover a register's value in the caller's frame.
+type RegRuleKind int
+
+const (
+	RuleUndefined RegRuleKind = iota
+	RuleSameValue
+	RuleOffset
+	RuleValOffset
+	RuleRegister
+	RuleExpression
+	RuleValExpression
+	RuleArchitectural
+)
+
+// RegRule is a tagged union describing how to recover one register's
+// value in the caller's frame. Which fields are meaningful depends on
+// Kind:
+//
+//	RuleUndefined      no other fields are used; the value was not preserved
+//	RuleSameValue      no other fields are used; the value is unchanged from the caller
+//	RuleOffset         CFA+Offset is the address the value was saved at
+//	RuleValOffset      CFA+Offset is the value itself
+//	RuleRegister       Register names the register the value now lives in
+//	RuleExpression     Expression is a DWARF expression for the address the value was saved at
+//	RuleValExpression  Expression is a DWARF expression for the value itself
+//	RuleArchitectural  the rule is defined by the target architecture, not DWARF
+type RegRule struct {
+	Kind       RegRuleKind
+	Offset     int64
+	Register   uint64
+	Expression []byte
+}
+
+// cfaRule is the current rule for computing the canonical frame
+// address: either Register+Offset, or, if Expression is non-nil, the
+// result of evaluating Expression.
+type cfaRule struct {
+	Register   uint64
+	Offset     int64
+	Expression []byte
+}
+
+func (r cfaRule) resolve(regs Registers, mem MemReader) (uintptr, error) {
+	if r.Expression != nil {
+		return evalLocationAddress(r.Expression, locInfo{}, regs, mem)
+	}
+
+	v, err := regs.Reg(r.Register)
+	if err != nil {
+		return 0, err
+	}
+
+	return uintptr(int64(v) + r.Offset), nil
+}
+
+// Registers gives access to the DWARF-numbered registers of a stack
+// frame, so the CFI and expression evaluators can be driven from a
+// live process, a core file, or a test fixture alike.
+type Registers interface {
+	Reg(dwarfColumn uint64) (uint64, error)
+
+	// FrameBase returns the value of the frame base DW_AT_frame_base
+	// resolves to for this frame, for evaluating DW_OP_fbreg.
+	FrameBase() (int64, error)
+
+	// PC returns the program counter this frame was executing at, so
+	// the unwinder knows which FDE to run next.
+	PC() (uint64, error)
+}
+
+// MemReader gives access to a region of a process' memory, playing the
+// same role io.ReaderAt does for files.
+type MemReader interface {
+	ReadAt(p []byte, off int64) (int, error)
+}
+
+// Frame is the result of unwinding one call frame: the canonical frame
+// address, and the rule for recovering every register the CFI program
+// had something to say about.
+type Frame struct {
+	CFA       uintptr
+	Registers map[uint64]RegRule
+
+	// ReturnColumn is the DWARF register column the CIE says holds the
+	// return address (the PC to resume the caller at), for callers
+	// that want to keep unwinding past this frame.
+	ReturnColumn uint64
+}
+
+// ReturnAddress resolves fr's rule for its ReturnColumn, giving the pc
+// execution will resume at in the calling frame once this one
+// returns. A result of 0 conventionally means there is no caller -
+// the outermost frame of the stack.
+func (fr *Frame) ReturnAddress(regs Registers, mem MemReader) (uintptr, error) {
+	return fr.Register(fr.ReturnColumn, regs, mem)
+}
+
+// Register resolves the rule for DWARF register col against regs and
+// mem, returning its value as saved in the frame that Frame describes.
+func (fr *Frame) Register(col uint64, regs Registers, mem MemReader) (uintptr, error) {
+	rule, ok := fr.Registers[col]
+	if !ok {
+		rule = RegRule{Kind: RuleUndefined}
+	}
+
+	switch rule.Kind {
+	case RuleUndefined:
+		return 0, fmt.Errorf("dwarf/unwind: register %d is undefined in this frame", col)
+
+	case RuleSameValue:
+		v, err := regs.Reg(col)
+		return uintptr(v), err
+
+	case RuleOffset:
+		if mem == nil {
+			return 0, fmt.Errorf("dwarf/unwind: register %d was saved to memory but no MemReader was given", col)
+		}
+		var buf [8]byte
+		if _, err := mem.ReadAt(buf[:], int64(fr.CFA)+rule.Offset); err != nil {
+			return 0, err
+		}
+		return uintptr(binary.LittleEndian.Uint64(buf[:])), nil
+
+	case RuleValOffset:
+		return uintptr(int64(fr.CFA) + rule.Offset), nil
+
+	case RuleRegister:
+		v, err := regs.Reg(rule.Register)
+		return uintptr(v), err
+
+	case RuleExpression:
+		addr, err := evalLocationAddress(rule.Expression, locInfo{CanonicalFrameAddress: fr.CFA}, regs, mem)
+		if err != nil {
+			return 0, err
+		}
+		if mem == nil {
+			return 0, fmt.Errorf("dwarf/unwind: register %d was saved via an expression but no MemReader was given", col)
+		}
+		var buf [8]byte
+		if _, err := mem.ReadAt(buf[:], int64(addr)); err != nil {
+			return 0, err
+		}
+		return uintptr(binary.LittleEndian.Uint64(buf[:])), nil
+
+	case RuleValExpression:
+		return evalLocationAddress(rule.Expression, locInfo{CanonicalFrameAddress: fr.CFA}, regs, mem)
+
+	default:
+		return 0, fmt.Errorf("dwarf/unwind: register %d has an unsupported rule kind", col)
+	}
+}
+
+// CommonInformationEntry holds the parts of a CIE that are shared by
+// every FrameDescriptionEntry that refers to it: the alignment factors
+// needed to decode the CFI program, and the initial CFA/register rules
+// the FDE's own instructions are applied on top of.
 type CommonInformationEntry struct {
 	CodeAlignmentFactor uintptr
 	DataAlignmentFactor int64
-	ReturnColumn        byte
+	ReturnColumn        uint64
+
+	InitialInstructions []byte
+	InitialCFA          cfaRule
+	InitialRules        map[uint64]RegRule
+
+	// FDEEncoding is the DW_EH_PE_* encoding FDEs referring to this CIE
+	// use for their initial_location/address_range fields. It comes
+	// from the CIE's 'R' augmentation letter and is only meaningful for
+	// .eh_frame; .debug_frame CIEs always leave it at DW_EH_PE_absptr.
+	FDEEncoding byte
 
+	order binary.ByteOrder
+}
+
+// FrameDescriptionEntry describes the range of the program's
+// instructions covered by one CIE, and the CFI program that describes
+// how the call frame information changes as the program counter
+// advances across that range.
+type FrameDescriptionEntry struct {
+	CIE             *CommonInformationEntry
 	InitialLocation uintptr
 	AddressRange    uintptr
 	Instructions    []byte
+}
 
-	StackRegister uint64
+// CanonicalFrameAddress is a convenience wrapper around FrameAt for
+// callers that already know the value of the register the CFI program
+// will define the CFA in terms of (almost always the stack pointer,
+// for the outermost frame) and don't need the rest of the per-register
+// rule table.
+func (d *Data) CanonicalFrameAddress(pc uintptr, sp uintptr) (uintptr, error) {
+	frame, err := d.FrameAt(pc, constRegisters(sp), nil)
+	if err != nil {
+		return 0, err
+	}
+	return frame.CFA, nil
+}
 
-	StackOffset int64
-	ColumnValue int64
-	order    binary.ByteOrder
+// constRegisters answers every DWARF register query with the same
+// value. It's enough to resolve a CFA rule when the caller already
+// knows which register it names and doesn't care about any other
+// register's value.
+type constRegisters uintptr
+
+func (r constRegisters) Reg(dwarfColumn uint64) (uint64, error) {
+	return uint64(r), nil
 }
 
-func (d *Data) CanonicalFrameAddress(pc uintptr, sp uintptr) (uintptr, error) {
+// FrameBase satisfies Registers; CanonicalFrameAddress's callers only
+// ever resolve a CFA rule, which never evaluates DW_OP_fbreg, so this
+// is never actually called.
+func (r constRegisters) FrameBase() (int64, error) {
+	return 0, errors.New("dwarf/unwind: constRegisters has no frame base")
+}
 
-	stream := bytes.NewReader(d.frame)
+// PC satisfies Registers; CanonicalFrameAddress already knows the pc
+// it wants the CFA for, so this is never actually called either.
+func (r constRegisters) PC() (uint64, error) {
+	return 0, errors.New("dwarf/unwind: constRegisters has no pc")
+}
 
-	for {
-		var length, id uint32
-		var pcstart, pccount uint64
+// FrameAt finds the FrameDescriptionEntry covering pc, runs its CIE's
+// and its own CFI instructions forward to pc, and resolves the
+// resulting rules against regs to produce pc's frame. mem may be nil
+// if the CFA rule is known not to be expression-based; a CFI program
+// whose CFA rule does reference memory (DW_CFA_def_cfa_expression)
+// will fail without one.
+func (d *Data) FrameAt(pc uintptr, regs Registers, mem MemReader) (*Frame, error) {
+	fde, err := d.fdeForPC(pc)
+	if err != nil {
+		return nil, err
+	}
 
-		err := binary.Read(stream, d.order, &length)
-		if err != nil {
-			return 0, err
+	st, err := fde.runTo(pc)
+	if err != nil {
+		return nil, err
+	}
+
+	cfa, err := st.cfa.resolve(regs, mem)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Frame{CFA: cfa, Registers: st.registers, ReturnColumn: fde.CIE.ReturnColumn}, nil
+}
+
+// cfiSource is one of the two sections that can hold call frame
+// information. .debug_frame and .eh_frame share almost all of their
+// encoding; where they differ (CIE id, the FDE's CIE pointer, and the
+// augmentation string) is handled by isEH below. addr is the section's
+// runtime load address, needed to resolve .eh_frame's DW_EH_PE_pcrel
+// FDE fields against real PCs; .debug_frame never uses that encoding,
+// so it's always 0 there.
+type cfiSource struct {
+	data []byte
+	isEH bool
+	addr uintptr
+}
+
+// cfiSources lists the sections fdeForPC should search, preferring
+// .debug_frame (which, unlike .eh_frame, is present even for functions
+// that can't throw) when both are available.
+func (d *Data) cfiSources() []cfiSource {
+	var sources []cfiSource
+	if len(d.frame) > 0 {
+		sources = append(sources, cfiSource{data: d.frame, isEH: false})
+	}
+	if len(d.ehFrame) > 0 {
+		sources = append(sources, cfiSource{data: d.ehFrame, isEH: true, addr: d.ehFrameAddr})
+	}
+	return sources
+}
+
+// fdeForPC scans the available call frame information for the
+// FrameDescriptionEntry covering pc, parsing (and running the initial
+// instructions of) its CIE along the way.
+func (d *Data) fdeForPC(pc uintptr) (*FrameDescriptionEntry, error) {
+	for _, source := range d.cfiSources() {
+		fde, err := fdeForPCIn(source, pc, d.order)
+		if err == nil {
+			return fde, nil
 		}
+	}
+
+	return nil, fmt.Errorf("dwarf/unwind: frame data didn't include pc")
+}
 
-		if length < 4 {
-			return 0, fmt.Errorf("dwarf/unwind: entry too short")
+func fdeForPCIn(source cfiSource, pc uintptr, order binary.ByteOrder) (*FrameDescriptionEntry, error) {
+
+	stream := bytes.NewReader(source.data)
+	cieMarker := uint64(0xFFFFFFFF)
+	if source.isEH {
+		cieMarker = 0
+	}
+
+	for {
+		length, is64, err := readInitialLength(stream, order)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
 		}
 
-		err = binary.Read(stream, d.order, &id)
+		entryEnd := stream.Len() - int(length)
+
+		idOffset := int64(len(source.data)) - int64(stream.Len())
+		id, err := readSectionOffset(stream, order, is64)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 
-		if id == 0xFFFFFFFF {
-			stream.Seek(int64(length) - 4, 1)
+		if id == cieMarker {
+			stream.Seek(int64(stream.Len())-int64(entryEnd), io.SeekCurrent)
 			continue
 		}
 
-		if length < 20 {
-			return 0, fmt.Errorf("dwarf/unwind: frame description entry too short")
+		cieOffset := id
+		if source.isEH {
+			// The FDE's CIE pointer is a self-relative back-offset:
+			// subtract it from the offset of the pointer field itself.
+			cieOffset = uint64(idOffset) - id
 		}
 
-		err = binary.Read(stream, d.order, &pcstart)
+		cie, err := parseCommonInformationEntry(source, cieOffset, order)
 		if err != nil {
-			return 0, err
-		}
-		err = binary.Read(stream, d.order, &pccount)
-		if err != nil {
-			return 0, err
+			return nil, err
 		}
 
-		if uintptr(pcstart) <= pc && pc < uintptr(pcstart+pccount) {
-			cie, err := d.parseCommonInformationEntry(id)
+		var pcstart, pccount uint64
+		if source.isEH {
+			// initial_location/address_range are encoded per the CIE's
+			// 'R' augmentation letter, rather than being plain addresses.
+			fieldAddr := source.addr + uintptr(len(source.data)) - uintptr(stream.Len())
+			loc, err := decodeEncodedPointer(stream, order, cie.FDEEncoding, fieldAddr)
 			if err != nil {
-				return 0, err
+				return nil, err
 			}
-			cie.InitialLocation = uintptr(pcstart)
-			cie.AddressRange = uintptr(pccount)
-			cie.Instructions = make([]byte, length-20)
-			cie.order = d.order
-			_, err = stream.Read(cie.Instructions)
+			count, err := decodeEncodedPointer(stream, order, cie.FDEEncoding&0x0f, 0)
 			if err != nil {
-				return 0, err
+				return nil, err
 			}
-			return cie.CanonicalFrameAddress(pc, sp)
+			pcstart, pccount = uint64(loc), uint64(count)
 		} else {
-			stream.Seek(int64(length) - 20, 1)
+			err = binary.Read(stream, order, &pcstart)
+			if err != nil {
+				return nil, err
+			}
+			err = binary.Read(stream, order, &pccount)
+			if err != nil {
+				return nil, err
+			}
 		}
+
+		if uintptr(pcstart) <= pc && pc < uintptr(pcstart+pccount) {
+			remaining := stream.Len() - entryEnd
+			if remaining < 0 {
+				return nil, fmt.Errorf("dwarf/unwind: frame description entry too short")
+			}
+
+			instructions := make([]byte, remaining)
+			if _, err := io.ReadFull(stream, instructions); err != nil {
+				return nil, err
+			}
+
+			return &FrameDescriptionEntry{
+				CIE:             cie,
+				InitialLocation: uintptr(pcstart),
+				AddressRange:    uintptr(pccount),
+				Instructions:    instructions,
+			}, nil
+		}
+
+		stream.Seek(int64(stream.Len())-int64(entryEnd), io.SeekCurrent)
 	}
 
-	return 0, fmt.Errorf("dwarf/unwind: frame data didn't include pc")
+	return nil, fmt.Errorf("dwarf/unwind: frame data didn't include pc")
 }
 
-func (d *Data) parseCommonInformationEntry(id uint32) (*CommonInformationEntry, error) {
+func parseCommonInformationEntry(source cfiSource, id uint64, order binary.ByteOrder) (*CommonInformationEntry, error) {
 
-	stream := bytes.NewReader(d.frame)
+	stream := bytes.NewReader(source.data)
 	stream.Seek(int64(id), 0)
 
-	var length, mark uint32
-
-	err := binary.Read(stream, d.order, &length)
+	length, is64, err := readInitialLength(stream, order)
 	if err != nil {
 		return nil, err
 	}
@@ -138,13 +440,18 @@ func (d *Data) parseCommonInformationEntry(id uint32) (*CommonInformationEntry,
 	}
 	stream = bytes.NewReader(entry)
 
-	err = binary.Read(stream, d.order, &mark)
+	mark, err := readSectionOffset(stream, order, is64)
 	if err != nil {
 		return nil, err
 	}
 
-	if length < 4 || mark != 0xFFFFFFFF {
-		return nil, fmt.Errorf("dwarf/unwind: No CommonInformationEntry found at d.frames:%x", id)
+	cieMarker := uint64(0xFFFFFFFF)
+	if source.isEH {
+		cieMarker = 0
+	}
+
+	if mark != cieMarker {
+		return nil, fmt.Errorf("dwarf/unwind: No CommonInformationEntry found at offset %x", id)
 	}
 
 	version, err := stream.ReadByte()
@@ -152,17 +459,28 @@ func (d *Data) parseCommonInformationEntry(id uint32) (*CommonInformationEntry,
 		return nil, err
 	}
 
-	if version != 3 {
+	if version != 1 && version != 3 && version != 4 {
 		return nil, fmt.Errorf("dwarf/unwind: unsupported dwarf version: %x", version)
 	}
 
-	augmentation, err := stream.ReadByte()
+	augmentation, err := readCString(stream)
 	if err != nil {
 		return nil, err
 	}
 
-	if augmentation != 0 {
-		return nil, fmt.Errorf("dwarf/unwind: unhandled dwarf augmentation")
+	if !source.isEH && augmentation != "" {
+		return nil, fmt.Errorf("dwarf/unwind: unhandled dwarf augmentation: %q", augmentation)
+	}
+
+	if version == 4 {
+		// address_size, segment_selector_size: meaningless without an
+		// augmentation that uses them.
+		if _, err := stream.ReadByte(); err != nil {
+			return nil, err
+		}
+		if _, err := stream.ReadByte(); err != nil {
+			return nil, err
+		}
 	}
 
 	codeAlignment, err := parseUnsignedLEB128(stream)
@@ -174,119 +492,401 @@ func (d *Data) parseCommonInformationEntry(id uint32) (*CommonInformationEntry,
 		return nil, err
 	}
 
-	returnColumn, err := stream.ReadByte()
-	if err != nil {
+	var returnColumn uint64
+	if version == 1 {
+		b, err := stream.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		returnColumn = uint64(b)
+	} else {
+		returnColumn, err = parseUnsignedLEB128(stream)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fdeEncoding := byte(dw_EH_PE_absptr)
+	if source.isEH {
+		fdeEncoding, err = parseEHAugmentation(augmentation, stream, order)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cie := &CommonInformationEntry{
+		CodeAlignmentFactor: uintptr(codeAlignment),
+		DataAlignmentFactor: dataAlignment,
+		ReturnColumn:        returnColumn,
+		FDEEncoding:         fdeEncoding,
+		order:               order,
+	}
+
+	cie.InitialInstructions = make([]byte, stream.Len())
+	if _, err := io.ReadFull(stream, cie.InitialInstructions); err != nil {
 		return nil, err
 	}
 
-	cie := &CommonInformationEntry{}
-	cie.CodeAlignmentFactor = uintptr(codeAlignment)
-	cie.DataAlignmentFactor = dataAlignment
-	cie.ReturnColumn = returnColumn
+	st := &cfiState{registers: map[uint64]RegRule{}, initial: map[uint64]RegRule{}}
+	if err := runCFIProgram(cie.InitialInstructions, cie, st, 0, false); err != nil {
+		return nil, err
+	}
 
-	err = cie.Update(stream)
-	if err == io.EOF {
-		return cie, nil
+	cie.InitialCFA = st.cfa
+	cie.InitialRules = st.registers
+
+	return cie, nil
+}
+
+// runTo runs fde's CIE's initial instructions followed by fde's own
+// instructions, stopping as soon as the next instruction would advance
+// past pc, and returns the resulting CFI state.
+func (fde *FrameDescriptionEntry) runTo(pc uintptr) (*cfiState, error) {
+	st := &cfiState{
+		loc:       fde.InitialLocation,
+		cfa:       fde.CIE.InitialCFA,
+		registers: cloneRules(fde.CIE.InitialRules),
+		initial:   fde.CIE.InitialRules,
+	}
+
+	if err := runCFIProgram(fde.Instructions, fde.CIE, st, pc, true); err != nil {
+		return nil, err
 	}
-	return nil, err
+
+	return st, nil
 }
 
-func (cie *CommonInformationEntry) Update(stream *bytes.Reader) error {
+// cfiState is the virtual machine state a CFI program mutates as it
+// runs: the location it currently describes, the rule for computing
+// the CFA, the rule table for every register, and a stack of earlier
+// states pushed by DW_CFA_remember_state.
+type cfiState struct {
+	loc       uintptr
+	cfa       cfaRule
+	registers map[uint64]RegRule
+	initial   map[uint64]RegRule
+	stack     []savedCFIState
+}
+
+type savedCFIState struct {
+	cfa       cfaRule
+	registers map[uint64]RegRule
+}
+
+func cloneRules(rules map[uint64]RegRule) map[uint64]RegRule {
+	out := make(map[uint64]RegRule, len(rules))
+	for k, v := range rules {
+		out[k] = v
+	}
+	return out
+}
+
+// runCFIProgram interprets a DWARF v3/v4 CFI program (�6.4.2) against
+// st. If bounded is true, execution stops as soon as the next
+// location-advancing opcode would move st.loc past target; this is how
+// FrameAt stops an FDE's program at the row covering the pc it was
+// asked about. If bounded is false the whole program is run, which is
+// how a CIE's initial_instructions populate the initial rule table.
+func runCFIProgram(instructions []byte, cie *CommonInformationEntry, st *cfiState, target uintptr, bounded bool) error {
+
+	stream := bytes.NewReader(instructions)
+	caf := cie.CodeAlignmentFactor
+	daf := cie.DataAlignmentFactor
+
+	advance := func(delta uintptr) bool {
+		if bounded && st.loc+delta > target {
+			return false
+		}
+		st.loc += delta
+		return true
+	}
 
 	for {
-		instruction, err := stream.ReadByte()
+		op, err := stream.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
 
-		switch instruction {
+		switch op & 0xc0 {
+		case dw_CFA_advance_loc:
+			if !advance(uintptr(op&0x3f) * caf) {
+				return nil
+			}
+			continue
+
+		case dw_CFA_offset:
+			reg := uint64(op & 0x3f)
+			off, err := parseUnsignedLEB128(stream)
+			if err != nil {
+				return err
+			}
+			st.registers[reg] = RegRule{Kind: RuleOffset, Offset: int64(off) * daf}
+			continue
+
+		case dw_CFA_restore:
+			reg := uint64(op & 0x3f)
+			restoreRegister(st, reg)
+			continue
+		}
+
+		switch op {
+		case dw_CFA_nop:
+			// No-op.
+
+		case dw_CFA_set_loc:
+			var addr uint64
+			if err := binary.Read(stream, cie.order, &addr); err != nil {
+				return err
+			}
+			if bounded && uintptr(addr) > target {
+				return nil
+			}
+			st.loc = uintptr(addr)
+
+		case dw_CFA_advance_loc1:
+			var delta uint8
+			if err := binary.Read(stream, cie.order, &delta); err != nil {
+				return err
+			}
+			if !advance(uintptr(delta) * caf) {
+				return nil
+			}
+
+		case dw_CFA_advance_loc2:
+			var delta uint16
+			if err := binary.Read(stream, cie.order, &delta); err != nil {
+				return err
+			}
+			if !advance(uintptr(delta) * caf) {
+				return nil
+			}
+
+		case dw_CFA_advance_loc4:
+			var delta uint32
+			if err := binary.Read(stream, cie.order, &delta); err != nil {
+				return err
+			}
+			if !advance(uintptr(delta) * caf) {
+				return nil
+			}
+
 		case dw_CFA_def_cfa:
 			reg, err := parseUnsignedLEB128(stream)
 			if err != nil {
 				return err
 			}
-			val, err := parseUnsignedLEB128(stream)
+			off, err := parseUnsignedLEB128(stream)
 			if err != nil {
 				return err
 			}
-			cie.StackRegister = reg
-			cie.StackOffset = int64(val)
+			st.cfa = cfaRule{Register: reg, Offset: int64(off)}
 
-		case dw_CFA_nop:
-			// No-op
+		case dw_CFA_def_cfa_sf:
+			reg, err := parseUnsignedLEB128(stream)
+			if err != nil {
+				return err
+			}
+			off, err := parseSignedLEB128(stream)
+			if err != nil {
+				return err
+			}
+			st.cfa = cfaRule{Register: reg, Offset: off * daf}
 
-		case dw_CFA_offset + cie.ReturnColumn:
+		case dw_CFA_def_cfa_register:
+			reg, err := parseUnsignedLEB128(stream)
+			if err != nil {
+				return err
+			}
+			st.cfa.Register = reg
+			st.cfa.Expression = nil
 
-			raw, err := parseSignedLEB128(stream)
+		case dw_CFA_def_cfa_offset:
+			off, err := parseUnsignedLEB128(stream)
 			if err != nil {
 				return err
 			}
-			cie.ColumnValue = raw * cie.DataAlignmentFactor
+			st.cfa.Offset = int64(off)
 
-		default:
+		case dw_CFA_def_cfa_offset_sf:
+			off, err := parseSignedLEB128(stream)
+			if err != nil {
+				return err
+			}
+			st.cfa.Offset = off * daf
 
-			return fmt.Errorf("Unsuported CFA op: %x", instruction)
-		}
-	}
+		case dw_CFA_def_cfa_expression:
+			expr, err := readBlock(stream)
+			if err != nil {
+				return err
+			}
+			st.cfa = cfaRule{Expression: expr}
 
-	return nil
-}
+		case dw_CFA_undefined:
+			reg, err := parseUnsignedLEB128(stream)
+			if err != nil {
+				return err
+			}
+			st.registers[reg] = RegRule{Kind: RuleUndefined}
 
-func (cie *CommonInformationEntry) CanonicalFrameAddress(pc uintptr, sp uintptr) (uintptr, error) {
-	loc := cie.InitialLocation
-	fmt.Println("loc :", loc, loc + cie.AddressRange, cie.Instructions)
-	offset := cie.StackOffset
+		case dw_CFA_same_value:
+			reg, err := parseUnsignedLEB128(stream)
+			if err != nil {
+				return err
+			}
+			st.registers[reg] = RegRule{Kind: RuleSameValue}
 
-	stream := bytes.NewReader(cie.Instructions)
+		case dw_CFA_register:
+			reg, err := parseUnsignedLEB128(stream)
+			if err != nil {
+				return err
+			}
+			other, err := parseUnsignedLEB128(stream)
+			if err != nil {
+				return err
+			}
+			st.registers[reg] = RegRule{Kind: RuleRegister, Register: other}
 
-	for {
-		instruction, err := stream.ReadByte()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return 0, err
-		}
+		case dw_CFA_remember_state:
+			st.stack = append(st.stack, savedCFIState{cfa: st.cfa, registers: cloneRules(st.registers)})
+
+		case dw_CFA_restore_state:
+			if len(st.stack) == 0 {
+				return errors.New("dwarf/unwind: DW_CFA_restore_state with an empty state stack")
+			}
+			saved := st.stack[len(st.stack)-1]
+			st.stack = st.stack[:len(st.stack)-1]
+			st.cfa = saved.cfa
+			st.registers = saved.registers
 
-		if instruction == dw_CFA_def_cfa_offset_sf {
-			delta, err := parseSignedLEB128(stream)
+		case dw_CFA_offset_extended:
+			reg, err := parseUnsignedLEB128(stream)
+			if err != nil {
+				return err
+			}
+			off, err := parseUnsignedLEB128(stream)
 			if err != nil {
-				return 0, err
+				return err
 			}
-			offset = delta * cie.DataAlignmentFactor
-			fmt.Println("offset: ", delta * cie.DataAlignmentFactor)
+			st.registers[reg] = RegRule{Kind: RuleOffset, Offset: int64(off) * daf}
 
-		} else {
-			// This is a change-of-address command
-			if loc > pc {
-				break
-			}
-			if instruction == dw_CFA_advance_loc1 {
-				var delta int8
-				err := binary.Read(stream, cie.order, &delta)
-				if err != nil {
-					return 0, err
-				}
-				loc += uintptr(delta) * cie.CodeAlignmentFactor
-				fmt.Println("loc :", loc)
-
-			} else if instruction == dw_CFA_advance_loc2 {
-				var delta int16
-				err := binary.Read(stream, cie.order, &delta)
-				if err != nil {
-					return 0, err
-				}
-				loc += uintptr(delta) * cie.CodeAlignmentFactor
-				fmt.Println("loc :", loc)
-
-			} else if instruction >= dw_CFA_advance_loc && instruction <= 0x80 {
-				loc += uintptr(instruction - 0x40) * cie.CodeAlignmentFactor
-				fmt.Println("loc :", loc)
-			} else {
-				return 0, fmt.Errorf("dwarf/unwind: unknown op-code: %x", instruction)
+		case dw_CFA_offset_extended_sf:
+			reg, err := parseUnsignedLEB128(stream)
+			if err != nil {
+				return err
+			}
+			off, err := parseSignedLEB128(stream)
+			if err != nil {
+				return err
+			}
+			st.registers[reg] = RegRule{Kind: RuleOffset, Offset: off * daf}
+
+		case dw_CFA_restore_extended:
+			reg, err := parseUnsignedLEB128(stream)
+			if err != nil {
+				return err
+			}
+			restoreRegister(st, reg)
+
+		case dw_CFA_val_offset:
+			reg, err := parseUnsignedLEB128(stream)
+			if err != nil {
+				return err
+			}
+			off, err := parseUnsignedLEB128(stream)
+			if err != nil {
+				return err
+			}
+			st.registers[reg] = RegRule{Kind: RuleValOffset, Offset: int64(off) * daf}
+
+		case dw_CFA_val_offset_sf:
+			reg, err := parseUnsignedLEB128(stream)
+			if err != nil {
+				return err
+			}
+			off, err := parseSignedLEB128(stream)
+			if err != nil {
+				return err
+			}
+			st.registers[reg] = RegRule{Kind: RuleValOffset, Offset: off * daf}
+
+		case dw_CFA_expression:
+			reg, err := parseUnsignedLEB128(stream)
+			if err != nil {
+				return err
+			}
+			expr, err := readBlock(stream)
+			if err != nil {
+				return err
 			}
+			st.registers[reg] = RegRule{Kind: RuleExpression, Expression: expr}
+
+		case dw_CFA_val_expression:
+			reg, err := parseUnsignedLEB128(stream)
+			if err != nil {
+				return err
+			}
+			expr, err := readBlock(stream)
+			if err != nil {
+				return err
+			}
+			st.registers[reg] = RegRule{Kind: RuleValExpression, Expression: expr}
+
+		default:
+			if op >= dw_CFA_lo_user && op <= dw_CFA_hi_user {
+				// Vendor or architecture-specific extension we don't
+				// understand the operands of; nothing safe to do but
+				// stop rather than misinterpret the rest of the stream.
+				return fmt.Errorf("dwarf/unwind: unsupported vendor CFA opcode: %#x", op)
+			}
+			return fmt.Errorf("dwarf/unwind: unsupported CFA opcode: %#x", op)
 		}
 	}
+}
 
-	return uintptr(int64(sp) + offset), nil
+// restoreRegister implements DW_CFA_restore/DW_CFA_restore_extended:
+// reg's rule reverts to whatever the CIE's initial instructions gave
+// it, or to RuleUndefined if the CIE said nothing about it.
+func restoreRegister(st *cfiState, reg uint64) {
+	if rule, ok := st.initial[reg]; ok {
+		st.registers[reg] = rule
+	} else {
+		delete(st.registers, reg)
+	}
+}
+
+// readBlock reads a ULEB128 length followed by that many bytes, the
+// encoding DWARF uses for BLOCK operands such as
+// DW_CFA_def_cfa_expression's.
+func readBlock(stream *bytes.Reader) ([]byte, error) {
+	n, err := parseUnsignedLEB128(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	block := make([]byte, n)
+	if _, err := io.ReadFull(stream, block); err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+// readCString reads a NUL-terminated string, the encoding DWARF uses
+// for a CIE's augmentation field.
+func readCString(stream *bytes.Reader) (string, error) {
+	var buf bytes.Buffer
+
+	for {
+		b, err := stream.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return buf.String(), nil
+		}
+		buf.WriteByte(b)
+	}
 }
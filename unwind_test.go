@@ -5,6 +5,31 @@ import (
 	"testing"
 )
 
+// fakeRegs answers every DWARF register query with the same value, for
+// exercising expression-based CFI rules without a real Registers.
+type fakeRegs uint64
+
+func (r fakeRegs) Reg(dwarfColumn uint64) (uint64, error) { return uint64(r), nil }
+func (r fakeRegs) FrameBase() (int64, error)              { return 0, nil }
+func (r fakeRegs) PC() (uint64, error)                    { return 0, nil }
+
+// TestCFARuleExpressionUsesRegisters makes sure an expression-based CFA
+// rule (DW_CFA_def_cfa_expression) is evaluated against the regs it's
+// given rather than in a vacuum: DW_OP_breg7 +16 against a register 7
+// value of 100 should produce 116, not fail for lack of a register.
+func TestCFARuleExpressionUsesRegisters(t *testing.T) {
+	rule := cfaRule{Expression: []byte{dw_OP_breg7, 16}}
+
+	cfa, err := rule.resolve(fakeRegs(100), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfa != 116 {
+		t.Errorf("cfa = %d, want 116", cfa)
+	}
+}
+
 func TestUnwindBasics(t *testing.T) {
 	f, err := macho.Open("testdata/x")
 
@@ -0,0 +1,131 @@
+package dwarf
+
+import (
+	"fmt"
+	"iter"
+	"unsafe"
+)
+
+// liveRegisters answers register queries from a fixed table of raw
+// DWARF-column values, for seeding a walk with a frame's actual
+// register state rather than one reconstructed from CFI rules.
+type liveRegisters struct {
+	pc   uint64
+	regs map[uint64]uint64
+}
+
+func (r *liveRegisters) Reg(col uint64) (uint64, error) {
+	v, ok := r.regs[col]
+	if !ok {
+		return 0, fmt.Errorf("dwarf/unwind: register %d is not available", col)
+	}
+	return v, nil
+}
+
+func (r *liveRegisters) FrameBase() (int64, error) {
+	return 0, fmt.Errorf("dwarf/unwind: no frame base available while unwinding")
+}
+
+func (r *liveRegisters) PC() (uint64, error) {
+	return r.pc, nil
+}
+
+// virtualRegisters answers register queries for a caller frame the
+// unwinder hasn't actually run CFI on yet: its values are whatever
+// frame's rule table says to recover, resolved against the callee
+// frame's own registers and memory.
+type virtualRegisters struct {
+	frame *Frame
+	child Registers
+	mem   MemReader
+	pc    uint64
+}
+
+func (v *virtualRegisters) Reg(col uint64) (uint64, error) {
+	addr, err := v.frame.Register(col, v.child, v.mem)
+	return uint64(addr), err
+}
+
+func (v *virtualRegisters) FrameBase() (int64, error) {
+	return 0, fmt.Errorf("dwarf/unwind: no frame base available while unwinding")
+}
+
+func (v *virtualRegisters) PC() (uint64, error) {
+	return v.pc, nil
+}
+
+// Unwind walks the call stack starting at regs (the innermost frame's
+// registers) using mem to read saved register values out of memory,
+// yielding each frame's CFI-resolved Frame from innermost to
+// outermost. The walk stops, without error, as soon as a frame's
+// return address resolves to 0 or its pc isn't covered by any FDE -
+// either of which ordinarily just means the bottom of the stack
+// (main, a goroutine's entry point, or a hand-written thunk with no
+// CFI) has been reached.
+func Unwind(d *Data, regs Registers, mem MemReader) iter.Seq[*Frame] {
+	return func(yield func(*Frame) bool) {
+		cur := regs
+
+		for {
+			pc, err := cur.PC()
+			if err != nil {
+				return
+			}
+
+			fr, err := d.FrameAt(uintptr(pc), cur, mem)
+			if err != nil {
+				return
+			}
+
+			if !yield(fr) {
+				return
+			}
+
+			ret, err := fr.ReturnAddress(cur, mem)
+			if err != nil || ret == 0 {
+				return
+			}
+
+			cur = &virtualRegisters{frame: fr, child: cur, mem: mem, pc: uint64(ret)}
+		}
+	}
+}
+
+// selfMemory implements MemReader by reading straight out of this
+// process' own address space, for UnwindSelf.
+type selfMemory struct{}
+
+// ReadAt reads directly out of this process' address space at the raw
+// address off. off comes from register/CFI state (e.g. a saved frame
+// pointer), not from any existing Go pointer, so there's no unsafe.Pointer
+// to carry forward and no way to express this as one of the "safe"
+// uintptr->Pointer conversions unsafe.Pointer's docs describe (arithmetic
+// on a pointer obtained earlier in the same expression). go vet's
+// unsafeptr check flags the conversion below ("possible misuse of
+// unsafe.Pointer") accordingly; that's expected and unavoidable for this
+// function's whole purpose of reading caller-supplied addresses, not a
+// bug to silence.
+func (selfMemory) ReadAt(p []byte, off int64) (int, error) {
+	copy(p, unsafe.Slice((*byte)(unsafe.Pointer(uintptr(off))), len(p)))
+	return len(p), nil
+}
+
+// UnwindSelf captures the calling goroutine's own stack pointer and
+// program counter and unwinds them against d, reading saved registers
+// directly out of this process via unsafe rather than through some
+// separate inspected process or core file.
+func UnwindSelf(d *Data) iter.Seq[*Frame] {
+	sp := getSP() + ptrSize // undo the CALL into getSP that pushed a return address
+	bp := getBP()
+	pc := getPC()
+
+	regs := &liveRegisters{
+		pc: uint64(pc),
+		regs: map[uint64]uint64{
+			dw_reg_sp: uint64(sp),
+			dw_reg_bp: uint64(bp),
+		},
+	}
+
+	return Unwind(d, regs, selfMemory{})
+}
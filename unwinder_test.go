@@ -0,0 +1,77 @@
+package dwarf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// buildDebugFrame assembles a minimal synthetic .debug_frame: one CIE
+// whose initial instructions set the CFA to dw_reg_bp+16 - the rule a
+// Go binary's frame-pointer convention actually produces for most of a
+// function's body - and one FDE covering [pc, pc+size).
+func buildDebugFrame(pc uintptr, size uint64) []byte {
+	var cieBody bytes.Buffer
+	binary.Write(&cieBody, binary.LittleEndian, uint32(0xffffffff)) // CIE_id
+	cieBody.WriteByte(1)                                            // version
+	cieBody.WriteByte(0)                                            // augmentation: ""
+	buildULEB128(&cieBody, 1)                                       // code_alignment_factor
+	buildSLEB128(&cieBody, -8)                                      // data_alignment_factor
+	cieBody.WriteByte(16)                                           // return_address_register
+
+	// DW_CFA_def_cfa dw_reg_bp, 16
+	cieBody.WriteByte(dw_CFA_def_cfa)
+	buildULEB128(&cieBody, dw_reg_bp)
+	buildULEB128(&cieBody, 16)
+
+	var frame bytes.Buffer
+	binary.Write(&frame, binary.LittleEndian, uint32(cieBody.Len()))
+	frame.Write(cieBody.Bytes())
+
+	var fdeBody bytes.Buffer
+	binary.Write(&fdeBody, binary.LittleEndian, uint32(0)) // CIE_pointer: CIE is at offset 0
+	binary.Write(&fdeBody, binary.LittleEndian, uint64(pc))
+	binary.Write(&fdeBody, binary.LittleEndian, size)
+
+	binary.Write(&frame, binary.LittleEndian, uint32(fdeBody.Len()))
+	frame.Write(fdeBody.Bytes())
+
+	return frame.Bytes()
+}
+
+// TestUnwindUsesFramePointerRegister makes sure Unwind can resolve a
+// CFA rule expressed in terms of dw_reg_bp: Go binaries' default
+// frame-pointer convention means the CFA is BP-relative through most
+// of a function, so a Registers that only seeds dw_reg_sp (as
+// UnwindSelf's liveRegisters used to) can't compute it.
+func TestUnwindUsesFramePointerRegister(t *testing.T) {
+	const pc = 0x1000
+	const bp = 0x7000
+
+	d, err := New(nil, nil, nil, nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.frame = buildDebugFrame(pc, 0x100)
+
+	regs := &liveRegisters{
+		pc: pc,
+		regs: map[uint64]uint64{
+			dw_reg_sp: 0,
+			dw_reg_bp: bp,
+		},
+	}
+
+	var frames []*Frame
+	for fr := range Unwind(d, regs, nil) {
+		frames = append(frames, fr)
+		break
+	}
+
+	if len(frames) != 1 {
+		t.Fatalf("got %d frames, want 1", len(frames))
+	}
+	if frames[0].CFA != bp+16 {
+		t.Errorf("CFA = %#x, want %#x", frames[0].CFA, bp+16)
+	}
+}